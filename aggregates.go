@@ -0,0 +1,313 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrAggregateSummariesNotEnabled is when aggregates are listed but the
+// aggregate summaries are not enabled in the config.
+var ErrAggregateSummariesNotEnabled = errors.New("aggregate summaries not enabled")
+
+// AggregateInfo is the summary of an aggregate. Only events saved with
+// AggregateSummaries enabled are counted, until the summary is rebuilt with
+// RebuildAggregateSummary or RebuildAggregateSummaries.
+type AggregateInfo struct {
+	ID            uuid.UUID
+	AggregateType eh.AggregateType
+	Version       int
+	EventCount    int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// AggregateInfo returns the summary of an aggregate, or
+// eh.ErrAggregateNotFound if it has no events.
+func (s *EventStore) AggregateInfo(ctx context.Context, id uuid.UUID) (*AggregateInfo, error) {
+	if !s.config.AggregateSummaries {
+		return nil, eh.EventStoreError{
+			Err:       ErrAggregateSummariesNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	table := s.service.Table(s.AggregateTableName(ctx))
+
+	var record dbAggregate
+	err := table.Get("AggregateID", id.String()).
+		Consistent(consistentRead(ctx, s.config.ReadConsistency)).
+		OneWithContext(ctx, &record)
+	if err == dynamo.ErrNotFound {
+		return nil, eh.EventStoreError{
+			Err:       eh.ErrAggregateNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return record.info(), nil
+}
+
+// ListAggregates lists a page of at most limit aggregates, of the aggregate
+// type if it is not empty. Pass an empty cursor for the first page and the
+// returned cursor for the next, until it is empty. A limit of 0 lists all
+// remaining aggregates. Listing by aggregate type uses a global secondary
+// index and is always eventually consistent.
+func (s *EventStore) ListAggregates(ctx context.Context, aggregateType eh.AggregateType, limit int, cursor string) ([]*AggregateInfo, string, error) {
+	if !s.config.AggregateSummaries {
+		return nil, "", eh.EventStoreError{
+			Err:       ErrAggregateSummariesNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	startKey, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", eh.EventStoreError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	table := s.service.Table(s.AggregateTableName(ctx))
+
+	var records []dbAggregate
+	var lastKey dynamo.PagingKey
+	if aggregateType != "" {
+		query := table.Get("AggregateType", aggregateType).Index("AggregateTypeIndex")
+		if startKey != nil {
+			query = query.StartFrom(startKey)
+		}
+		if limit > 0 {
+			query = query.Limit(int64(limit))
+		}
+		lastKey, err = query.AllWithLastEvaluatedKeyContext(ctx, &records)
+	} else {
+		scan := table.Scan().Consistent(consistentRead(ctx, s.config.ReadConsistency))
+		if startKey != nil {
+			scan = scan.StartFrom(startKey)
+		}
+		if limit > 0 {
+			scan = scan.Limit(int64(limit))
+		}
+		lastKey, err = scan.AllWithLastEvaluatedKeyContext(ctx, &records)
+	}
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, "", eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	infos := make([]*AggregateInfo, len(records))
+	for i, r := range records {
+		infos[i] = r.info()
+	}
+
+	next, err := encodeCursor(lastKey)
+	if err != nil {
+		return nil, "", eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return infos, next, nil
+}
+
+// RebuildAggregateSummary rebuilds the summary of an aggregate from its
+// events, for events saved before AggregateSummaries was enabled or changed
+// by writes that do not update the summary. The summary is removed if the
+// aggregate has no events. A save during the rebuild makes it start over.
+func (s *EventStore) RebuildAggregateSummary(ctx context.Context, id uuid.UUID) error {
+	if !s.config.AggregateSummaries {
+		return eh.EventStoreError{
+			Err:       ErrAggregateSummariesNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	for {
+		err := s.rebuildAggregateSummary(ctx, id)
+		if isConditionalCheckFailed(err) {
+			continue
+		} else if err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil
+	}
+}
+
+// RebuildAggregateSummaries rebuilds the summaries of all aggregates with
+// events or summaries, see RebuildAggregateSummary. It scans the full event
+// table.
+func (s *EventStore) RebuildAggregateSummaries(ctx context.Context) error {
+	if !s.config.AggregateSummaries {
+		return eh.EventStoreError{
+			Err:       ErrAggregateSummariesNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	ids := map[uuid.UUID]bool{}
+	for _, name := range []string{s.TableName(ctx), s.AggregateTableName(ctx)} {
+		iter := s.service.Table(name).Scan().Project("AggregateID").Iter()
+		var record struct{ AggregateID uuid.UUID }
+		for iter.NextWithContext(ctx, &record) {
+			ids[record.AggregateID] = true
+		}
+		if err := iter.Err(); err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotQuery,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	for id := range ids {
+		if err := s.RebuildAggregateSummary(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildAggregateSummary writes the summary of the current events, on the
+// condition that the summary is unchanged since reading them.
+func (s *EventStore) rebuildAggregateSummary(ctx context.Context, id uuid.UUID) error {
+	table := s.service.Table(s.AggregateTableName(ctx))
+
+	var current dbAggregate
+	err := table.Get("AggregateID", id.String()).
+		Consistent(true).
+		OneWithContext(ctx, &current)
+	exists := err == nil
+	if err != nil && err != dynamo.ErrNotFound {
+		return err
+	}
+	cond, args := "attribute_not_exists(AggregateID)", []interface{}{}
+	if exists {
+		cond, args = "'Version' = ?", []interface{}{current.Version}
+	}
+
+	var dbEvents []dbEvent
+	err = s.service.Table(s.TableName(ctx)).Get("AggregateID", id.String()).
+		Consistent(true).
+		AllWithContext(ctx, &dbEvents)
+	if err != nil && err != dynamo.ErrNotFound {
+		return err
+	}
+
+	if len(dbEvents) == 0 {
+		if !exists {
+			return nil
+		}
+		return table.Delete("AggregateID", id.String()).
+			If(cond, args...).
+			RunWithContext(ctx)
+	}
+
+	first, last := dbEvents[0], dbEvents[len(dbEvents)-1]
+	return table.Put(dbAggregate{
+		AggregateID:   id,
+		AggregateType: first.AggregateType,
+		Version:       last.Version,
+		EventCount:    len(dbEvents),
+		CreatedAt:     first.Timestamp,
+		UpdatedAt:     last.Timestamp,
+	}).If(cond, args...).RunWithContext(ctx)
+}
+
+// aggregateSummaryUpdate returns the update of the aggregate summary for
+// saved events. The version condition guards against concurrent saves, in
+// addition to the conditions of the events themselves.
+func (s *EventStore) aggregateSummaryUpdate(ctx context.Context, events []eh.Event, originalVersion int) *dynamo.Update {
+	first, last := events[0], events[len(events)-1]
+	table := s.service.Table(s.AggregateTableName(ctx))
+	return table.Update("AggregateID", first.AggregateID().String()).
+		Set("AggregateType", first.AggregateType()).
+		Set("Version", last.Version()).
+		Set("UpdatedAt", last.Timestamp()).
+		SetIfNotExists("CreatedAt", first.Timestamp()).
+		Add("EventCount", len(events)).
+		If("attribute_not_exists(AggregateID) OR 'Version' = ?", originalVersion)
+}
+
+// createAggregateTable creates the aggregate summary table.
+func (s *EventStore) createAggregateTable(ctx context.Context) error {
+	if err := s.service.CreateTable(s.AggregateTableName(ctx), dbAggregate{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.AggregateTableName(ctx)),
+	}
+	if err := s.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AggregateTableName appends the namespace, if one is set, to the aggregate
+// table prefix to get the name of the table to use.
+func (s *EventStore) AggregateTableName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.config.AggregateTablePrefix + "_" + ns
+}
+
+// dbAggregate is the summary record of an aggregate.
+type dbAggregate struct {
+	AggregateID   uuid.UUID        `dynamo:",hash"`
+	AggregateType eh.AggregateType `index:"AggregateTypeIndex,hash"`
+
+	Version    int
+	EventCount int
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (r dbAggregate) info() *AggregateInfo {
+	return &AggregateInfo{
+		ID:            r.AggregateID,
+		AggregateType: r.AggregateType,
+		Version:       r.Version,
+		EventCount:    r.EventCount,
+		CreatedAt:     r.CreatedAt,
+		UpdatedAt:     r.UpdatedAt,
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AggregatesTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event and aggregate tables
+func (suite *AggregatesTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix:          "eventhorizonTest_" + uuid.New().String(),
+		AggregateTablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:             os.Getenv("DYNAMODB_HOST"),
+		AggregateSummaries:   true,
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the tables
+func (suite *AggregatesTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *AggregatesTestSuite) TestAggregateInfo() {
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	_, err := suite.store.AggregateInfo(ctx, id)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != eh.ErrAggregateNotFound {
+		suite.T().Error("there should be an aggregate not found error:", err)
+	}
+
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp.Add(time.Second), mocks.AggregateType, id, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp.Add(time.Minute), mocks.AggregateType, id, 3),
+	}, 2)
+	assert.Nil(suite.T(), err)
+
+	// A conflicting save changes neither the events nor the summary.
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp.Add(time.Hour), mocks.AggregateType, id, 3),
+	}, 2)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrCouldNotSaveAggregate {
+		suite.T().Error("there should be a could not save aggregate error:", err)
+	}
+
+	info, err := suite.store.AggregateInfo(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &AggregateInfo{
+		ID:            id,
+		AggregateType: mocks.AggregateType,
+		Version:       3,
+		EventCount:    3,
+		CreatedAt:     timestamp,
+		UpdatedAt:     timestamp.Add(time.Minute),
+	}, info)
+}
+
+func (suite *AggregatesTestSuite) TestListAggregates() {
+	ctx := context.Background()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	ids := map[uuid.UUID]bool{}
+	for i := 0; i < 3; i++ {
+		id := uuid.New()
+		ids[id] = true
+		err := suite.store.Save(ctx, []eh.Event{
+			eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+				timestamp, mocks.AggregateType, id, 1),
+		}, 0)
+		assert.Nil(suite.T(), err)
+	}
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, eh.AggregateType("Other"), uuid.New(), 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// Page through all aggregates.
+	var infos []*AggregateInfo
+	cursor := ""
+	for {
+		page, next, err := suite.store.ListAggregates(ctx, "", 2, cursor)
+		assert.Nil(suite.T(), err)
+		infos = append(infos, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Len(suite.T(), infos, 4)
+
+	infos, cursor, err = suite.store.ListAggregates(ctx, mocks.AggregateType, 0, "")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "", cursor)
+	if assert.Len(suite.T(), infos, 3) {
+		for _, info := range infos {
+			assert.True(suite.T(), ids[info.ID])
+			assert.Equal(suite.T(), 1, info.Version)
+		}
+	}
+}
+
+func (suite *AggregatesTestSuite) TestRebuildAggregateSummaries() {
+	ctx := context.Background()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	// Events saved without summaries, sharing the event table.
+	store := NewEventStoreWithDB(&EventStoreConfig{
+		TablePrefix: suite.store.config.TablePrefix,
+	}, suite.store.service)
+	id := uuid.New()
+	err := store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp.Add(time.Second), mocks.AggregateType, id, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// A summary without events.
+	removedID := uuid.New()
+	err = suite.store.service.Table(suite.store.AggregateTableName(ctx)).
+		Put(dbAggregate{AggregateID: removedID, AggregateType: mocks.AggregateType, Version: 1}).
+		Run()
+	assert.Nil(suite.T(), err)
+
+	assert.Nil(suite.T(), suite.store.RebuildAggregateSummaries(ctx))
+
+	info, err := suite.store.AggregateInfo(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &AggregateInfo{
+		ID:            id,
+		AggregateType: mocks.AggregateType,
+		Version:       2,
+		EventCount:    2,
+		CreatedAt:     timestamp,
+		UpdatedAt:     timestamp.Add(time.Second),
+	}, info)
+
+	_, err = suite.store.AggregateInfo(ctx, removedID)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != eh.ErrAggregateNotFound {
+		suite.T().Error("there should be an aggregate not found error:", err)
+	}
+
+	// Saves continue from the rebuilt summary.
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp.Add(time.Minute), mocks.AggregateType, id, 3),
+	}, 2)
+	assert.Nil(suite.T(), err)
+	info, err = suite.store.AggregateInfo(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, info.EventCount)
+}
+
+// TestAggregatesTestSuite starts the test suite
+func TestAggregatesTestSuite(t *testing.T) {
+	suite.Run(t, new(AggregatesTestSuite))
+}
+
+func TestSaveSummaryTxLimits(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{AggregateSummaries: true}, nil)
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	// The events and the summary must fit in one transaction.
+	events := make([]eh.Event, MaxTxItems)
+	for i := range events {
+		events[i] = eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+			timestamp, mocks.AggregateType, id, i+1)
+	}
+	err := store.Save(context.Background(), events, 0)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrTxTooLarge {
+		t.Error("there should be a transaction too large error:", err)
+	}
+
+	// The summary can only be updated once per transaction.
+	ctx := NewContextWithTx(context.Background(), NewTx(nil))
+	assert.Nil(t, store.Save(ctx, events[:1], 0))
+	err = store.Save(ctx, events[1:2], 1)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrTxDuplicateItem {
+		t.Error("there should be a duplicate item error:", err)
+	}
+}
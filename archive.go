@@ -0,0 +1,244 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrNoArchiveSink is when the archiver is run without a sink.
+var ErrNoArchiveSink = errors.New("no archive sink")
+
+// ErrNoStreamsClient is when the archiver is run without a streams client,
+// for an event store created with NewEventStoreWithDB.
+var ErrNoStreamsClient = errors.New("no streams client")
+
+// ArchiveSink stores expired events before they are lost.
+type ArchiveSink interface {
+	// Archive stores an expired event. The event is not retried once Archive
+	// has returned without error.
+	Archive(ctx context.Context, event eh.Event) error
+}
+
+// ArchiverConfig is a config for RunArchiver.
+type ArchiverConfig struct {
+	// Sink is where the expired events are stored.
+	Sink ArchiveSink
+	// Streams is the DynamoDB Streams client, defaults to a client with the
+	// session of NewEventStore. It must be set for an event store created
+	// with NewEventStoreWithDB.
+	Streams dynamodbstreamsiface.DynamoDBStreamsAPI
+	// Checkpointer stores the stream positions, defaults to an in-memory
+	// checkpointer which archives the whole retained stream after a restart.
+	Checkpointer StreamCheckpointer
+	// PollInterval is how often the stream is polled when there are no new
+	// records, defaults to one second.
+	PollInterval time.Duration
+}
+
+func (c *ArchiverConfig) provideDefaults() {
+	if c.Checkpointer == nil {
+		c.Checkpointer = NewMemoryStreamCheckpointer()
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = time.Second
+	}
+}
+
+// RunArchiver archives events removed by the TTL of the event table to the
+// sink, by tailing the table stream. Events removed in other ways are not
+// archived. It blocks until the context is canceled or archiving fails. As
+// DynamoDB keeps stream records for 24 hours the archiver must not be stopped
+// for longer than that, or expired events are lost.
+func (s *EventStore) RunArchiver(ctx context.Context, config *ArchiverConfig) error {
+	if config == nil || config.Sink == nil {
+		return eh.EventStoreError{
+			Err:       ErrNoArchiveSink,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	config.provideDefaults()
+
+	streams := config.Streams
+	if streams == nil {
+		streams = s.streams
+	}
+	if streams == nil {
+		return eh.EventStoreError{
+			Err:       ErrNoStreamsClient,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	reader, err := newStreamReader(ctx, s.service, streams, s.TableName(ctx))
+	if err != nil {
+		if err == ErrStreamNotEnabled {
+			return eh.EventStoreError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return eh.EventStoreError{
+			Err:       ErrCouldNotReadStream,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	reader.checkpointer = config.Checkpointer
+	reader.pollInterval = config.PollInterval
+
+	err = reader.run(ctx, func(ctx context.Context, record *dynamodbstreams.Record) error {
+		event, err := s.expiredEvent(ctx, record)
+		if err != nil || event == nil {
+			return err
+		}
+		return config.Sink.Archive(ctx, event)
+	})
+	if err != nil && ctx.Err() == nil {
+		return eh.EventStoreError{
+			Err:       ErrCouldNotReadStream,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// expiredEvent decodes the event of a stream record if it was removed by the
+// TTL of the table, otherwise it returns nil.
+func (s *EventStore) expiredEvent(ctx context.Context, record *dynamodbstreams.Record) (eh.Event, error) {
+	if aws.StringValue(record.EventName) != dynamodbstreams.OperationTypeRemove ||
+		record.UserIdentity == nil ||
+		aws.StringValue(record.UserIdentity.Type) != "Service" ||
+		aws.StringValue(record.UserIdentity.PrincipalId) != "dynamodb.amazonaws.com" {
+		return nil, nil
+	}
+	if record.Dynamodb == nil || len(record.Dynamodb.OldImage) == 0 {
+		return nil, nil
+	}
+
+	var e dbEvent
+	if err := dynamo.UnmarshalItem(record.Dynamodb.OldImage, &e); err != nil {
+		return nil, err
+	}
+	events, err := s.buildEvents(ctx, []dbEvent{e})
+	if err != nil {
+		return nil, err
+	}
+
+	return events[0], nil
+}
+
+// FileArchiveSink is an ArchiveSink that appends the events to a file as
+// newline delimited JSON, useful for tests and small deployments.
+type FileArchiveSink struct {
+	file *os.File
+	enc  *json.Encoder
+	mu   sync.Mutex
+}
+
+// NewFileArchiveSink creates a new FileArchiveSink, appending to the file at
+// path which is created if needed.
+func NewFileArchiveSink(path string) (*FileArchiveSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileArchiveSink{
+		file: file,
+		enc:  json.NewEncoder(file),
+	}, nil
+}
+
+// Archive implements the Archive method of the ArchiveSink interface. The
+// file is synced before returning.
+func (f *FileArchiveSink) Archive(ctx context.Context, event eh.Event) error {
+	record, err := newJSONEvent(event)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.enc.Encode(record); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Close closes the file.
+func (f *FileArchiveSink) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// jsonEvent is the JSON representation of an event.
+type jsonEvent struct {
+	EventType     eh.EventType     `json:"event_type"`
+	AggregateType eh.AggregateType `json:"aggregate_type"`
+	AggregateID   uuid.UUID        `json:"aggregate_id"`
+	Version       int              `json:"version"`
+	Timestamp     time.Time        `json:"timestamp"`
+	Data          json.RawMessage  `json:"data,omitempty"`
+}
+
+// newJSONEvent returns the JSON representation of an event. The data of
+// events from the store without a registered data type is kept as decoded
+// from DynamoDB.
+func newJSONEvent(e eh.Event) (*jsonEvent, error) {
+	var data interface{} = e.Data()
+	if se, ok := e.(event); ok && se.data == nil && len(se.RawData) > 0 {
+		var raw map[string]interface{}
+		if err := dynamodbattribute.UnmarshalMap(se.RawData, &raw); err != nil {
+			return nil, err
+		}
+		data = raw
+	}
+
+	record := &jsonEvent{
+		EventType:     e.EventType(),
+		AggregateType: e.AggregateType(),
+		AggregateID:   e.AggregateID(),
+		Version:       e.Version(),
+		Timestamp:     e.Timestamp(),
+	}
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		record.Data = b
+	}
+
+	return record, nil
+}
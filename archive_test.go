@@ -0,0 +1,145 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetention(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{
+		Retention: map[eh.AggregateType]time.Duration{
+			mocks.AggregateType: 24 * time.Hour,
+		},
+	}, nil)
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	e, err := store.newDBEvent(context.Background(), eh.NewEventForAggregate(mocks.EventType, nil,
+		timestamp, mocks.AggregateType, uuid.New(), 1))
+	assert.Nil(t, err)
+	assert.Equal(t, timestamp.Add(24*time.Hour).Unix(), e.ExpiresAt)
+
+	e, err = store.newDBEvent(context.Background(), eh.NewEventForAggregate(mocks.EventType, nil,
+		timestamp, eh.AggregateType("Other"), uuid.New(), 1))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), e.ExpiresAt)
+}
+
+func TestExpiredEvent(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	e, err := newDBEvent(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1))
+	assert.Nil(t, err)
+	image, err := dynamo.MarshalItem(e)
+	assert.Nil(t, err)
+
+	ttl := &dynamodbstreams.Identity{
+		Type:        aws.String("Service"),
+		PrincipalId: aws.String("dynamodb.amazonaws.com"),
+	}
+	event, err := store.expiredEvent(ctx, &dynamodbstreams.Record{
+		EventName:    aws.String(dynamodbstreams.OperationTypeRemove),
+		UserIdentity: ttl,
+		Dynamodb:     &dynamodbstreams.StreamRecord{OldImage: image},
+	})
+	assert.Nil(t, err)
+	if assert.NotNil(t, event) {
+		assert.Equal(t, id, event.AggregateID())
+		assert.Equal(t, 1, event.Version())
+		assert.Equal(t, &mocks.EventData{Content: "event1"}, event.Data())
+	}
+
+	// Removes by users are not archived.
+	event, err = store.expiredEvent(ctx, &dynamodbstreams.Record{
+		EventName: aws.String(dynamodbstreams.OperationTypeRemove),
+		Dynamodb:  &dynamodbstreams.StreamRecord{OldImage: image},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, event)
+
+	event, err = store.expiredEvent(ctx, &dynamodbstreams.Record{
+		EventName:    aws.String(dynamodbstreams.OperationTypeInsert),
+		UserIdentity: ttl,
+		Dynamodb:     &dynamodbstreams.StreamRecord{NewImage: image},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, event)
+}
+
+func TestFileArchiveSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.json")
+
+	sink, err := NewFileArchiveSink(path)
+	assert.Nil(t, err)
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	for i := 1; i <= 2; i++ {
+		err := sink.Archive(context.Background(), eh.NewEventForAggregate(mocks.EventType,
+			&mocks.EventData{Content: "event"}, timestamp, mocks.AggregateType, id, i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, sink.Close())
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if assert.Len(t, lines, 2) {
+		var record jsonEvent
+		assert.Nil(t, json.Unmarshal([]byte(lines[1]), &record))
+		assert.Equal(t, mocks.EventType, record.EventType)
+		assert.Equal(t, id, record.AggregateID)
+		assert.Equal(t, 2, record.Version)
+		assert.True(t, timestamp.Equal(record.Timestamp))
+		assert.JSONEq(t, `{"Content":"event"}`, string(record.Data))
+	}
+}
+
+func TestRunArchiverNoStreamsClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	sink, err := NewFileArchiveSink(filepath.Join(dir, "events.json"))
+	assert.Nil(t, err)
+	defer sink.Close()
+
+	// A store with its own DB has no streams client to default to.
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	err = store.RunArchiver(context.Background(), &ArchiverConfig{Sink: sink})
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrNoStreamsClient {
+		t.Error("there should be a no streams client error:", err)
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrAuditLogNotEnabled is when the audit log is read but it is not enabled
+// in the config.
+var ErrAuditLogNotEnabled = errors.New("audit log not enabled")
+
+// AuditOperation is the maintenance operation that changed an event.
+type AuditOperation string
+
+const (
+	// AuditReplace is an event replaced with Replace.
+	AuditReplace AuditOperation = "replace"
+	// AuditRename is an event renamed with RenameEvent or RenameEventJob.
+	AuditRename AuditOperation = "rename"
+	// AuditMigrate is an event transformed in place by a migration.
+	AuditMigrate AuditOperation = "migrate"
+	// AuditDelete is an event dropped in place by a migration.
+	AuditDelete AuditOperation = "delete"
+	// AuditCorrect is an event corrected by a Corrector.
+	AuditCorrect AuditOperation = "correct"
+	// AuditRollback is an event restored by rolling back a correction.
+	AuditRollback AuditOperation = "rollback"
+)
+
+// AuditEntry is a change of an event in the audit log.
+type AuditEntry struct {
+	AggregateID uuid.UUID
+	Version     int
+	Operation   AuditOperation
+	// Operator and Reason are from the context of the change, see
+	// NewContextWithAuditInfo.
+	Operator string
+	Reason   string
+	// Previous is the event as it was before the change.
+	Previous  eh.Event
+	ChangedAt time.Time
+}
+
+type auditContextKey int
+
+const auditKey auditContextKey = iota
+
+type auditInfo struct {
+	operator, reason string
+}
+
+// NewContextWithAuditInfo returns the context with the operator and reason
+// of maintenance operations done with it, recorded in the audit log.
+func NewContextWithAuditInfo(ctx context.Context, operator, reason string) context.Context {
+	return context.WithValue(ctx, auditKey, auditInfo{operator: operator, reason: reason})
+}
+
+// AuditInfoFromContext returns the operator and reason from the context, if
+// set.
+func AuditInfoFromContext(ctx context.Context) (operator, reason string) {
+	info, _ := ctx.Value(auditKey).(auditInfo)
+	return info.operator, info.reason
+}
+
+// AuditLog returns the audit log of an aggregate, oldest change first.
+func (s *EventStore) AuditLog(ctx context.Context, id uuid.UUID) ([]*AuditEntry, error) {
+	if !s.config.AuditLog {
+		return nil, eh.EventStoreError{
+			Err:       ErrAuditLogNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	table := s.service.Table(s.AuditTableName(ctx))
+
+	var records []dbAuditRecord
+	err := table.Get("AggregateID", id.String()).
+		Consistent(consistentRead(ctx, s.config.ReadConsistency)).
+		AllWithContext(ctx, &records)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	previous := make([]dbEvent, len(records))
+	for i, r := range records {
+		previous[i] = r.Previous
+	}
+	events, err := s.buildEvents(ctx, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*AuditEntry, len(records))
+	for i, r := range records {
+		entries[i] = &AuditEntry{
+			AggregateID: r.AggregateID,
+			Version:     r.Version,
+			Operation:   r.Operation,
+			Operator:    r.Operator,
+			Reason:      r.Reason,
+			Previous:    events[i],
+			ChangedAt:   r.ChangedAt,
+		}
+	}
+
+	return entries, nil
+}
+
+// auditedWrite runs the conditional write of an event, a *dynamo.Put,
+// *dynamo.Update or *dynamo.Delete, and returns false if its condition
+// failed. The extra writes, if any, are applied in the same transaction. With
+// the audit log enabled the previous image of the event is recorded in the
+// same transaction as the write. As a transaction can not return the old
+// item, the event is read first and the write is only applied if it is
+// unchanged since, else it returns false as well.
+func (s *EventStore) auditedWrite(ctx context.Context, operation AuditOperation,
+	id uuid.UUID, version int, write interface{}, extra ...txOp) (bool, error) {
+	if !s.config.AuditLog && len(extra) == 0 {
+		var err error
+		switch w := write.(type) {
+		case *dynamo.Put:
+			err = w.RunWithContext(ctx)
+		case *dynamo.Update:
+			err = w.RunWithContext(ctx)
+		case *dynamo.Delete:
+			err = w.RunWithContext(ctx)
+		default:
+			return false, fmt.Errorf("unsupported write %T", write)
+		}
+		if isConditionalCheckFailed(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	var previous dbEvent
+	cond, args := "", []interface{}{}
+	if s.config.AuditLog {
+		table := s.service.Table(s.TableName(ctx))
+		var item map[string]*dynamodb.AttributeValue
+		err := table.Get("AggregateID", id.String()).
+			Range("Version", dynamo.Equal, version).
+			Consistent(true).OneWithContext(ctx, &item)
+		if err == dynamo.ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if err := dynamo.UnmarshalItem(item, &previous); err != nil {
+			return false, err
+		}
+		cond, args = unchangedCondition(item)
+	}
+
+	desc := fmt.Sprintf("%s %s@%d", operation, id, version)
+	tx := s.NewTx()
+	switch w := write.(type) {
+	case *dynamo.Put:
+		if cond != "" {
+			w.If(cond, args...)
+		}
+		tx.put(desc, w)
+	case *dynamo.Update:
+		if cond != "" {
+			w.If(cond, args...)
+		}
+		tx.update(desc, w)
+	case *dynamo.Delete:
+		if cond != "" {
+			w.If(cond, args...)
+		}
+		tx.delete(desc, w)
+	default:
+		return false, fmt.Errorf("unsupported write %T", write)
+	}
+	if err := tx.addAll(extra); err != nil {
+		return false, err
+	}
+	if put := s.auditPut(ctx, operation, &previous); put != nil {
+		tx.put("audit "+desc, put)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		if err, ok := err.(TxError); ok && err.Err == ErrTxCanceled &&
+			len(err.Reasons) > 0 && err.Reasons[0].Code == "ConditionalCheckFailed" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// auditPut returns the write of the audit record of a changed event, or nil
+// if the audit log is not enabled.
+func (s *EventStore) auditPut(ctx context.Context, operation AuditOperation, previous *dbEvent) *dynamo.Put {
+	if !s.config.AuditLog {
+		return nil
+	}
+
+	operator, reason := AuditInfoFromContext(ctx)
+	now := time.Now()
+	table := s.service.Table(s.AuditTableName(ctx))
+	return table.Put(dbAuditRecord{
+		AggregateID: previous.AggregateID,
+		Subject:     auditSubject(now, previous.Version),
+		Version:     previous.Version,
+		Operation:   operation,
+		Operator:    operator,
+		Reason:      reason,
+		Previous:    *previous,
+		ChangedAt:   now,
+	})
+}
+
+// auditSubject is the range key of an audit record, which sorts the records
+// of an aggregate by time.
+func auditSubject(t time.Time, version int) string {
+	return fmt.Sprintf("%019d/%d", t.UnixNano(), version)
+}
+
+// createAuditTable creates the audit table.
+func (s *EventStore) createAuditTable(ctx context.Context) error {
+	if err := s.service.CreateTable(s.AuditTableName(ctx), dbAuditRecord{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.AuditTableName(ctx)),
+	}
+	if err := s.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AuditTableName appends the namespace, if one is set, to the audit table
+// prefix to get the name of the table to use.
+func (s *EventStore) AuditTableName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.config.AuditTablePrefix + "_" + ns
+}
+
+// dbAuditRecord is the previous image of a changed event.
+type dbAuditRecord struct {
+	AggregateID uuid.UUID `dynamo:",hash"`
+	Subject     string    `dynamo:",range"`
+
+	Version   int
+	Operation AuditOperation
+	Operator  string `dynamo:",omitempty"`
+	Reason    string `dynamo:",omitempty"`
+	Previous  dbEvent
+	ChangedAt time.Time
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditLogTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event and audit tables
+func (suite *AuditLogTestSuite) SetupTest() {
+	var err error
+	prefix := "eventhorizonTest_" + uuid.New().String()
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix:      prefix,
+		Endpoint:         os.Getenv("DYNAMODB_HOST"),
+		AuditLog:         true,
+		AuditTablePrefix: prefix + "_audit",
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the tables
+func (suite *AuditLogTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *AuditLogTestSuite) TestReplaceAndRename() {
+	ctx := NewContextWithAuditInfo(context.Background(), "alice", "fix typo")
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// Saving events is not audited.
+	entries, err := suite.store.AuditLog(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), entries)
+
+	err = suite.store.Replace(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 1))
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), suite.store.RenameEvent(ctx, mocks.EventType, mocks.EventOtherType))
+
+	entries, err = suite.store.AuditLog(ctx, id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), entries, 2) {
+		assert.Equal(suite.T(), AuditReplace, entries[0].Operation)
+		assert.Equal(suite.T(), "alice", entries[0].Operator)
+		assert.Equal(suite.T(), "fix typo", entries[0].Reason)
+		assert.Equal(suite.T(), 1, entries[0].Version)
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1"}, entries[0].Previous.Data())
+
+		assert.Equal(suite.T(), AuditRename, entries[1].Operation)
+		assert.Equal(suite.T(), mocks.EventType, entries[1].Previous.EventType())
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event2"}, entries[1].Previous.Data())
+	}
+}
+
+func (suite *AuditLogTestSuite) TestFailedReplace() {
+	ctx := context.Background()
+	id := uuid.New()
+
+	err := suite.store.Replace(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		time.Now(), mocks.AggregateType, id, 1))
+	assert.Equal(suite.T(), eh.ErrAggregateNotFound, err)
+
+	entries, err := suite.store.AuditLog(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), entries)
+}
+
+func (suite *AuditLogTestSuite) TestMigrate() {
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	migrator := NewMigrator(suite.store, &MigratorConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+	})
+	assert.Nil(suite.T(), migrator.CreateTable(ctx), "could not create table")
+	defer migrator.DeleteTable(ctx)
+
+	// A copying migration does not use the audit log of the source.
+	migration := &Migration{
+		ID:                "copy",
+		EventTypes:        []eh.EventType{mocks.EventType},
+		Transform:         uppercase,
+		TargetTablePrefix: "eventhorizonTest_" + uuid.New().String(),
+	}
+	results, err := migrator.Run(ctx, migration)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), results, 1) {
+		assert.Equal(suite.T(), int64(1), results[0].Transformed)
+	}
+	target, err := NewEventStore(&EventStoreConfig{
+		TablePrefix: migration.TargetTablePrefix,
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err)
+	defer target.DeleteTable(ctx)
+
+	events, err := target.Load(ctx, id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 1) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1!"}, events[0].Data())
+	}
+
+	// An in-place migration records the previous event.
+	_, err = migrator.Run(ctx, &Migration{
+		ID:         "transform",
+		EventTypes: []eh.EventType{mocks.EventType},
+		Transform:  uppercase,
+	})
+	assert.Nil(suite.T(), err)
+
+	entries, err := suite.store.AuditLog(ctx, id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), entries, 1) {
+		assert.Equal(suite.T(), AuditMigrate, entries[0].Operation)
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1"}, entries[0].Previous.Data())
+	}
+}
+
+// TestAuditLogTestSuite starts the test suite
+func TestAuditLogTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditLogTestSuite))
+}
+
+func TestAuditInfoFromContext(t *testing.T) {
+	operator, reason := AuditInfoFromContext(context.Background())
+	assert.Equal(t, "", operator)
+	assert.Equal(t, "", reason)
+
+	ctx := NewContextWithAuditInfo(context.Background(), "alice", "fix typo")
+	operator, reason = AuditInfoFromContext(ctx)
+	assert.Equal(t, "alice", operator)
+	assert.Equal(t, "fix typo", reason)
+}
+
+func TestAuditSubject(t *testing.T) {
+	t1 := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Nanosecond)
+	assert.True(t, auditSubject(t1, 10) < auditSubject(t2, 1))
+	assert.Equal(t, "1257894000000000000/3", auditSubject(t1, 3))
+}
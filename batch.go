@@ -0,0 +1,146 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// FindMany finds the entities for all IDs with batched reads. The result has
+// the same length and order as ids, with a nil entity for every ID that was
+// not found. The reads are split into chunks of the DynamoDB limit of 100
+// keys and unprocessed keys are retried with an exponential backoff.
+func (r *Repo) FindMany(ctx context.Context, ids []uuid.UUID) ([]eh.Entity, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	result := make([]eh.Entity, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+
+	// A batch can not contain the same key twice.
+	keys := make([]dynamo.Keyed, 0, len(ids))
+	seen := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			keys = append(keys, dynamo.Keys{id.String()})
+			seen[id] = true
+		}
+	}
+
+	table := r.service.Table(r.config.TableName)
+	iter := table.Batch("ID").Get(keys...).Consistent(consistentRead(ctx, r.config.ReadConsistency)).Iter()
+	found := map[uuid.UUID]eh.Entity{}
+	entity := r.factoryFn()
+	for iter.NextWithContext(ctx, entity) {
+		found[entity.EntityID()] = entity
+		entity = r.factoryFn()
+	}
+	if err := iter.Err(); err != nil && err != dynamo.ErrNotFound {
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotQuery,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	for i, id := range ids {
+		result[i] = found[id]
+	}
+
+	return result, nil
+}
+
+// SaveMany saves all entities with batched writes. The writes are split into
+// chunks of the DynamoDB limit of 25 items and unprocessed items are retried
+// with an exponential backoff. If an ID is used more than once the last
+// entity with the ID is saved. On error some of the entities may have been
+// saved.
+func (r *Repo) SaveMany(ctx context.Context, entities []eh.Entity) error {
+	if len(entities) == 0 {
+		return nil
+	}
+
+	// A batch can not contain the same key twice.
+	items := make([]interface{}, 0, len(entities))
+	index := map[uuid.UUID]int{}
+	for _, entity := range entities {
+		id := entity.EntityID()
+		if id == uuid.Nil {
+			return eh.RepoError{
+				Err:       eh.ErrCouldNotSaveEntity,
+				BaseErr:   eh.ErrMissingEntityID,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		if i, ok := index[id]; ok {
+			items[i] = entity
+			continue
+		}
+		index[id] = len(items)
+		items = append(items, entity)
+	}
+
+	table := r.service.Table(r.config.TableName)
+	if _, err := table.Batch().Write().Put(items...).RunWithContext(ctx); err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// RemoveMany removes the entities for all IDs with batched writes. The writes
+// are split into chunks of the DynamoDB limit of 25 items and unprocessed
+// items are retried with an exponential backoff. On error some of the
+// entities may have been removed.
+func (r *Repo) RemoveMany(ctx context.Context, ids []uuid.UUID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// A batch can not contain the same key twice.
+	keys := make([]dynamo.Keyed, 0, len(ids))
+	seen := map[uuid.UUID]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			keys = append(keys, dynamo.Keys{id.String()})
+			seen[id] = true
+		}
+	}
+
+	table := r.service.Table(r.config.TableName)
+	if _, err := table.Batch("ID").Write().Delete(keys...).RunWithContext(ctx); err != nil {
+		return eh.RepoError{
+			Err:       ErrCouldNotRemoveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
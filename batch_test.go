@@ -0,0 +1,88 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *RepoTestSuite) TestSaveManyAndFindMany() {
+	// More than the batch limits to exercise the chunking.
+	entities := make([]eh.Entity, 120)
+	ids := make([]uuid.UUID, 0, len(entities)+1)
+	for i := range entities {
+		entities[i] = &TestModel{ID: uuid.New(), Content: "test"}
+		ids = append(ids, entities[i].EntityID())
+	}
+	missingID := uuid.New()
+	ids = append([]uuid.UUID{missingID}, ids...)
+
+	err := suite.repo.SaveMany(context.Background(), entities)
+	if err != nil {
+		suite.T().Fatal("error saving entities:", err)
+	}
+
+	results, err := suite.repo.FindMany(context.Background(), ids)
+	if err != nil {
+		suite.T().Fatal("error finding entities:", err)
+	}
+	assert.Equal(suite.T(), len(ids), len(results))
+	assert.Nil(suite.T(), results[0])
+	for i, result := range results[1:] {
+		if assert.NotNil(suite.T(), result) {
+			assert.Equal(suite.T(), ids[i+1], result.EntityID())
+		}
+	}
+}
+
+func (suite *RepoTestSuite) TestRemoveMany() {
+	entities := []eh.Entity{
+		&TestModel{ID: uuid.New(), Content: "test"},
+		&TestModel{ID: uuid.New(), Content: "test2"},
+	}
+	_ = suite.repo.SaveMany(context.Background(), entities)
+
+	// Duplicate IDs are removed once.
+	err := suite.repo.RemoveMany(context.Background(), []uuid.UUID{entities[0].EntityID(), entities[1].EntityID(), entities[0].EntityID()})
+	if err != nil {
+		suite.T().Fatal("error removing entities:", err)
+	}
+
+	results, err := suite.repo.FindMany(context.Background(), []uuid.UUID{entities[0].EntityID(), entities[1].EntityID()})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []eh.Entity{nil, nil}, results)
+}
+
+func (suite *RepoTestSuite) TestSaveManyEmptyUUID() {
+	err := suite.repo.SaveMany(context.Background(), []eh.Entity{&TestModel{Content: "test"}})
+	assert.EqualError(suite.T(), err, "could not save entity: missing entity ID (default)")
+}
+
+func (suite *RepoTestSuite) TestSaveManyDuplicateIDs() {
+	id := uuid.New()
+	err := suite.repo.SaveMany(context.Background(), []eh.Entity{
+		&TestModel{ID: id, Content: "first"},
+		&TestModel{ID: id, Content: "last"},
+	})
+	assert.Nil(suite.T(), err)
+
+	result, err := suite.repo.Find(context.Background(), id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "last", result.(*TestModel).Content)
+}
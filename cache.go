@@ -0,0 +1,334 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrNoDynamoDBRepo is when a DynamoDB repo is needed but could not be found
+// among the parents of a repo.
+var ErrNoDynamoDBRepo = errors.New("no DynamoDB repo")
+
+// CacheConfig is a config for the caching repo.
+type CacheConfig struct {
+	// Size is the maximum number of cached entities, defaults to 1000.
+	Size int
+	// TTL is how long an entity is cached, defaults to one minute.
+	TTL time.Duration
+}
+
+func (c *CacheConfig) provideDefaults() {
+	if c.Size == 0 {
+		c.Size = 1000
+	}
+	if c.TTL == 0 {
+		c.TTL = time.Minute
+	}
+}
+
+// CacheStats are the metrics of a caching repo.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+// HitRate returns the share of finds served from the cache, between 0 and 1.
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheRepo is a read-through cache for a repo, keeping the most recently
+// found entities in an in-process LRU cache with a TTL. Entities are
+// invalidated when they are saved or removed through the CacheRepo, and
+// optionally from the table stream with RunInvalidation to also catch
+// writes by other processes.
+//
+// Writes that do not go through the Save and Remove methods of the
+// CacheRepo, such as Repo.Update, Repo.SaveIf, Repo.RemoveIf and any write
+// added to a Tx, are not seen by the cache. Call Invalidate after them, or
+// use RunInvalidation.
+//
+// Entities are cached encoded as DynamoDB items and every Find returns a new
+// copy, so callers can change the found entities. Entities must be pointers
+// to structs that can be encoded as items, other entities are not cached.
+type CacheRepo struct {
+	eh.ReadWriteRepo
+
+	config *CacheConfig
+	now    func() time.Time
+
+	lru   *list.List
+	items map[uuid.UUID]map[string]*list.Element
+	// finds are the finds in flight per ID, to not cache entities found
+	// before an invalidation.
+	finds   map[uuid.UUID]*cacheFind
+	stats   CacheStats
+	cacheMu sync.Mutex
+}
+
+// cacheEntry is a cached entity.
+type cacheEntry struct {
+	ns      string
+	id      uuid.UUID
+	typ     reflect.Type
+	item    map[string]*dynamodb.AttributeValue
+	expires time.Time
+}
+
+// entity returns a new copy of the cached entity.
+func (e *cacheEntry) entity() (eh.Entity, error) {
+	entity := reflect.New(e.typ.Elem()).Interface().(eh.Entity)
+	if err := dynamo.UnmarshalItem(e.item, entity); err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// cacheFind counts the finds in flight of an ID and the invalidations of
+// the ID since the first of them started.
+type cacheFind struct {
+	finds      int
+	generation uint64
+}
+
+// NewCacheRepo creates a new CacheRepo.
+func NewCacheRepo(repo eh.ReadWriteRepo, config *CacheConfig) *CacheRepo {
+	if config == nil {
+		config = &CacheConfig{}
+	}
+	config.provideDefaults()
+
+	return &CacheRepo{
+		ReadWriteRepo: repo,
+		config:        config,
+		now:           time.Now,
+		lru:           list.New(),
+		items:         map[uuid.UUID]map[string]*list.Element{},
+		finds:         map[uuid.UUID]*cacheFind{},
+	}
+}
+
+// Parent implements the Parent method of the eventhorizon.ReadRepo interface.
+func (r *CacheRepo) Parent() eh.ReadRepo {
+	return r.ReadWriteRepo
+}
+
+// Find implements the Find method of the eventhorizon.ReadRepo interface.
+func (r *CacheRepo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	ns := eh.NamespaceFromContext(ctx)
+
+	// First check the cache.
+	r.cacheMu.Lock()
+	if elem, ok := r.items[id][ns]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if r.now().Before(entry.expires) {
+			r.lru.MoveToFront(elem)
+			r.stats.Hits++
+			r.cacheMu.Unlock()
+			return entry.entity()
+		}
+		r.remove(elem)
+	}
+	r.stats.Misses++
+	f, ok := r.finds[id]
+	if !ok {
+		f = &cacheFind{}
+		r.finds[id] = f
+	}
+	f.finds++
+	generation := f.generation
+	r.cacheMu.Unlock()
+
+	// Fetch and store the entity in the cache, if it was not invalidated
+	// while it was fetched.
+	entity, err := r.ReadWriteRepo.Find(ctx, id)
+
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+	if f.finds--; f.finds == 0 {
+		delete(r.finds, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.generation == generation {
+		r.add(ns, entity)
+	}
+
+	return entity, nil
+}
+
+// FindAll implements the FindAll method of the eventhorizon.ReadRepo interface.
+func (r *CacheRepo) FindAll(ctx context.Context) ([]eh.Entity, error) {
+	return r.ReadWriteRepo.FindAll(ctx)
+}
+
+// Save implements the Save method of the eventhorizon.WriteRepo interface.
+func (r *CacheRepo) Save(ctx context.Context, entity eh.Entity) error {
+	// Bust the cache both before and after the write, to not keep an entity
+	// that was found while the write was in flight.
+	r.Invalidate(entity.EntityID())
+	defer r.Invalidate(entity.EntityID())
+
+	return r.ReadWriteRepo.Save(ctx, entity)
+}
+
+// Remove implements the Remove method of the eventhorizon.WriteRepo interface.
+func (r *CacheRepo) Remove(ctx context.Context, id uuid.UUID) error {
+	r.Invalidate(id)
+	defer r.Invalidate(id)
+
+	return r.ReadWriteRepo.Remove(ctx, id)
+}
+
+// Invalidate removes the entity from the cache in all namespaces.
+func (r *CacheRepo) Invalidate(id uuid.UUID) {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+
+	for _, elem := range r.items[id] {
+		r.remove(elem)
+	}
+	if f, ok := r.finds[id]; ok {
+		f.generation++
+	}
+}
+
+// Purge removes all entities from the cache.
+func (r *CacheRepo) Purge() {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+
+	r.lru.Init()
+	r.items = map[uuid.UUID]map[string]*list.Element{}
+	for _, f := range r.finds {
+		f.generation++
+	}
+}
+
+// Stats returns the current metrics of the cache.
+func (r *CacheRepo) Stats() CacheStats {
+	r.cacheMu.Lock()
+	defer r.cacheMu.Unlock()
+
+	stats := r.stats
+	stats.Size = r.lru.Len()
+	return stats
+}
+
+// RunInvalidation invalidates cached entities when they are changed in the
+// table, by watching the table stream of the underlying DynamoDB repo. It
+// blocks until the context is canceled or the watch fails.
+func (r *CacheRepo) RunInvalidation(ctx context.Context, config *WatchConfig) error {
+	repo := Repository(r.ReadWriteRepo)
+	if repo == nil {
+		return eh.RepoError{
+			Err:       ErrNoDynamoDBRepo,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Copy the config to not change the caller's.
+	c := WatchConfig{}
+	if config != nil {
+		c = *config
+	}
+	c.FromLatest = true
+
+	w, err := repo.Watch(ctx, &c)
+	if err != nil {
+		return err
+	}
+	for change := range w.Changes() {
+		r.Invalidate(change.ID)
+	}
+
+	return w.Err()
+}
+
+// add adds an entity to the cache, evicting the least recently used entity
+// if the cache is full. Entities that are not pointers or can not be encoded
+// are not cached. The lock must be held.
+func (r *CacheRepo) add(ns string, entity eh.Entity) {
+	typ := reflect.TypeOf(entity)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return
+	}
+	item, err := dynamo.MarshalItem(entity)
+	if err != nil {
+		return
+	}
+
+	id := entity.EntityID()
+	if elem, ok := r.items[id][ns]; ok {
+		r.remove(elem)
+	}
+
+	elem := r.lru.PushFront(&cacheEntry{
+		ns:      ns,
+		id:      id,
+		typ:     typ,
+		item:    item,
+		expires: r.now().Add(r.config.TTL),
+	})
+	if _, ok := r.items[id]; !ok {
+		r.items[id] = map[string]*list.Element{}
+	}
+	r.items[id][ns] = elem
+
+	for r.lru.Len() > r.config.Size {
+		r.remove(r.lru.Back())
+		r.stats.Evictions++
+	}
+}
+
+// remove removes an element from the cache, the lock must be held.
+func (r *CacheRepo) remove(elem *list.Element) {
+	entry := r.lru.Remove(elem).(*cacheEntry)
+	delete(r.items[entry.id], entry.ns)
+	if len(r.items[entry.id]) == 0 {
+		delete(r.items, entry.id)
+	}
+}
+
+// Repository returns the DynamoDB repo among the repo and its parents, or nil
+// if there is none.
+func Repository(repo eh.ReadRepo) *Repo {
+	if repo == nil {
+		return nil
+	}
+
+	if r, ok := repo.(*Repo); ok {
+		return r
+	}
+
+	return Repository(repo.Parent())
+}
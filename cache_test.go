@@ -0,0 +1,164 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheRepoFind(t *testing.T) {
+	model := &mocks.SimpleModel{ID: uuid.New(), Content: "test"}
+	baseRepo := &mocks.Repo{Entity: model}
+	r := NewCacheRepo(baseRepo, nil)
+	assert.Equal(t, baseRepo, r.Parent())
+
+	// Cache on find.
+	entity, err := r.Find(context.Background(), model.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, model, entity)
+	assert.True(t, baseRepo.FindCalled)
+
+	baseRepo.FindCalled = false
+	entity, err = r.Find(context.Background(), model.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, model, entity)
+	assert.False(t, baseRepo.FindCalled, "the entity should be cached")
+
+	// Other namespaces are cached separately.
+	_, _ = r.Find(eh.NewContextWithNamespace(context.Background(), "ns"), model.ID)
+	assert.True(t, baseRepo.FindCalled)
+
+	stats := r.Stats()
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 2, Size: 2}, stats)
+	assert.InDelta(t, 1.0/3, stats.HitRate(), 0.001)
+}
+
+func TestCacheRepoInvalidation(t *testing.T) {
+	model := &mocks.SimpleModel{ID: uuid.New(), Content: "test"}
+	baseRepo := &mocks.Repo{Entity: model}
+	r := NewCacheRepo(baseRepo, nil)
+
+	// Bust the cache on save.
+	_, _ = r.Find(context.Background(), model.ID)
+	assert.Nil(t, r.Save(context.Background(), model))
+	assert.True(t, baseRepo.SaveCalled)
+	baseRepo.FindCalled = false
+	_, _ = r.Find(context.Background(), model.ID)
+	assert.True(t, baseRepo.FindCalled)
+
+	// Bust the cache on remove.
+	assert.Nil(t, r.Remove(context.Background(), model.ID))
+	assert.True(t, baseRepo.RemoveCalled)
+	assert.Equal(t, 0, r.Stats().Size)
+
+	// Don't cache errors.
+	baseRepo.LoadErr = eh.ErrEntityNotFound
+	_, err := r.Find(context.Background(), model.ID)
+	assert.Equal(t, eh.ErrEntityNotFound, err)
+	assert.Equal(t, 0, r.Stats().Size)
+}
+
+func TestCacheRepoTTL(t *testing.T) {
+	model := &mocks.SimpleModel{ID: uuid.New(), Content: "test"}
+	baseRepo := &mocks.Repo{Entity: model}
+	r := NewCacheRepo(baseRepo, &CacheConfig{TTL: time.Second})
+	now := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	_, _ = r.Find(context.Background(), model.ID)
+	baseRepo.FindCalled = false
+	now = now.Add(2 * time.Second)
+	_, _ = r.Find(context.Background(), model.ID)
+	assert.True(t, baseRepo.FindCalled, "the entity should have expired")
+}
+
+func TestCacheRepoEviction(t *testing.T) {
+	baseRepo := &mocks.Repo{}
+	r := NewCacheRepo(baseRepo, &CacheConfig{Size: 2})
+
+	ids := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	for _, id := range ids {
+		baseRepo.Entity = &mocks.SimpleModel{ID: id}
+		_, _ = r.Find(context.Background(), id)
+	}
+	assert.Equal(t, CacheStats{Misses: 3, Evictions: 1, Size: 2}, r.Stats())
+
+	// The least recently used entity is evicted.
+	baseRepo.FindCalled = false
+	_, _ = r.Find(context.Background(), ids[2])
+	assert.False(t, baseRepo.FindCalled)
+	baseRepo.Entity = &mocks.SimpleModel{ID: ids[0]}
+	_, _ = r.Find(context.Background(), ids[0])
+	assert.True(t, baseRepo.FindCalled)
+}
+
+func TestCacheRepoRunInvalidationWithoutRepo(t *testing.T) {
+	r := NewCacheRepo(&mocks.Repo{}, nil)
+	err := r.RunInvalidation(context.Background(), nil)
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrNoDynamoDBRepo {
+		t.Error("there should be a no DynamoDB repo error:", err)
+	}
+}
+
+func TestCacheRepoFindCopies(t *testing.T) {
+	model := &mocks.SimpleModel{ID: uuid.New(), Content: "test"}
+	r := NewCacheRepo(&mocks.Repo{Entity: model}, nil)
+
+	entity, err := r.Find(context.Background(), model.ID)
+	assert.Nil(t, err)
+	entity.(*mocks.SimpleModel).Content = "changed"
+
+	// Changes to found entities are not cached.
+	entity1, err := r.Find(context.Background(), model.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, &mocks.SimpleModel{ID: model.ID, Content: "test"}, entity1)
+	entity2, err := r.Find(context.Background(), model.ID)
+	assert.Nil(t, err)
+	assert.False(t, entity1 == entity2, "every find should return a copy")
+}
+
+func TestCacheRepoFindInvalidated(t *testing.T) {
+	model := &mocks.SimpleModel{ID: uuid.New(), Content: "test"}
+	var r *CacheRepo
+	r = NewCacheRepo(&findHookRepo{
+		ReadWriteRepo: &mocks.Repo{Entity: model},
+		hook:          func() { r.Invalidate(model.ID) },
+	}, nil)
+
+	// An entity invalidated while it was found is not cached.
+	entity, err := r.Find(context.Background(), model.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, model, entity)
+	assert.Equal(t, 0, r.Stats().Size)
+	assert.Len(t, r.finds, 0)
+}
+
+// findHookRepo calls the hook during every find.
+type findHookRepo struct {
+	eh.ReadWriteRepo
+	hook func()
+}
+
+func (r *findHookRepo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
+	r.hook()
+	return r.ReadWriteRepo.Find(ctx, id)
+}
@@ -0,0 +1,338 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCheckpointConflict is when a checkpoint was changed by someone else.
+var ErrCheckpointConflict = errors.New("checkpoint conflict")
+
+// ErrCouldNotLoadCheckpoint is when a checkpoint could not be loaded.
+var ErrCouldNotLoadCheckpoint = errors.New("could not load checkpoint")
+
+// ErrCouldNotSaveCheckpoint is when a checkpoint could not be saved.
+var ErrCouldNotSaveCheckpoint = errors.New("could not save checkpoint")
+
+// CheckpointError is an error in the checkpoint store.
+type CheckpointError struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Namespace is the namespace for the error.
+	Namespace string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e CheckpointError) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	return errStr + " (" + e.Namespace + ")"
+}
+
+// globalPositionSubject is the subject of the global position of a projector.
+const globalPositionSubject = "$global"
+
+// CheckpointStoreConfig is a config for the DynamoDB checkpoint store.
+type CheckpointStoreConfig struct {
+	TablePrefix string
+	Region      string
+	Endpoint    string
+}
+
+func (c *CheckpointStoreConfig) provideDefaults() {
+	if c.TablePrefix == "" {
+		c.TablePrefix = "eventhorizonCheckpoints"
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+}
+
+// Checkpoint is how far a projector has processed events, either as a global
+// position, as the version per aggregate or both.
+type Checkpoint struct {
+	Position int64
+	Versions map[uuid.UUID]int
+}
+
+// CheckpointStore stores the checkpoints of projectors, one table per
+// namespace. All changes are compare-and-set operations, so that two
+// instances of a projector can not overwrite each others progress.
+type CheckpointStore struct {
+	service *dynamo.DB
+	config  *CheckpointStoreConfig
+}
+
+// NewCheckpointStore creates a new CheckpointStore.
+func NewCheckpointStore(config *CheckpointStoreConfig) (*CheckpointStore, error) {
+	config.provideDefaults()
+
+	awsConfig := &aws.Config{
+		Region:   aws.String(config.Region),
+		Endpoint: aws.String(config.Endpoint),
+	}
+
+	session, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	db := dynamo.New(session)
+	return NewCheckpointStoreWithDB(config, db), nil
+}
+
+// NewCheckpointStoreWithDB creates a new CheckpointStore with DB
+func NewCheckpointStoreWithDB(config *CheckpointStoreConfig, db *dynamo.DB) *CheckpointStore {
+	config.provideDefaults()
+
+	return &CheckpointStore{
+		service: db,
+		config:  config,
+	}
+}
+
+// Load returns the checkpoint of the projector, which is empty if the
+// projector has not processed anything yet.
+func (s *CheckpointStore) Load(ctx context.Context, projector string) (*Checkpoint, error) {
+	table := s.service.Table(s.TableName(ctx))
+
+	var records []dbCheckpoint
+	err := table.Get("Projector", projector).Consistent(true).AllWithContext(ctx, &records)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, CheckpointError{
+			Err:       ErrCouldNotLoadCheckpoint,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	cp := &Checkpoint{
+		Versions: map[uuid.UUID]int{},
+	}
+	for _, r := range records {
+		if r.Subject == globalPositionSubject {
+			cp.Position = r.Position
+			continue
+		} else if strings.HasPrefix(r.Subject, "$") {
+			continue
+		}
+		id, err := uuid.Parse(r.Subject)
+		if err != nil {
+			return nil, CheckpointError{
+				Err:       ErrCouldNotLoadCheckpoint,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		cp.Versions[id] = int(r.Position)
+	}
+
+	return cp, nil
+}
+
+// SetPosition sets the global position of the projector to position, if the
+// current position is old. Otherwise ErrCheckpointConflict is returned.
+func (s *CheckpointStore) SetPosition(ctx context.Context, projector string, old, position int64) error {
+	return s.set(ctx, projector, globalPositionSubject, old, position)
+}
+
+// SetVersion sets the processed version of the aggregate for the projector
+// to version, if the current version is old. Otherwise ErrCheckpointConflict
+// is returned.
+func (s *CheckpointStore) SetVersion(ctx context.Context, projector string, id uuid.UUID, old, version int) error {
+	return s.set(ctx, projector, id.String(), int64(old), int64(version))
+}
+
+func (s *CheckpointStore) set(ctx context.Context, projector, subject string, old, position int64) error {
+	table := s.service.Table(s.TableName(ctx))
+
+	put := table.Put(dbCheckpoint{
+		Projector: projector,
+		Subject:   subject,
+		Position:  position,
+		UpdatedAt: time.Now(),
+	})
+	if old == 0 {
+		put = put.If("attribute_not_exists(Projector) OR 'Position' = ?", 0)
+	} else {
+		put = put.If("'Position' = ?", old)
+	}
+
+	if err := put.RunWithContext(ctx); err != nil {
+		if isConditionalCheckFailed(err) {
+			return CheckpointError{
+				Err:       ErrCheckpointConflict,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return CheckpointError{
+			Err:       ErrCouldNotSaveCheckpoint,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// LoadProgress implements the LoadProgress method of the JobProgressStore
+// interface, with the job as the projector.
+func (s *CheckpointStore) LoadProgress(ctx context.Context, job string, segment int) (string, bool, error) {
+	table := s.service.Table(s.TableName(ctx))
+
+	var record dbCheckpoint
+	err := table.Get("Projector", job).Range("Subject", dynamo.Equal, segmentSubject(segment)).
+		Consistent(true).OneWithContext(ctx, &record)
+	if err == dynamo.ErrNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, CheckpointError{
+			Err:       ErrCouldNotLoadCheckpoint,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return record.Cursor, record.Done, nil
+}
+
+// SaveProgress implements the SaveProgress method of the JobProgressStore
+// interface, with the job as the projector.
+func (s *CheckpointStore) SaveProgress(ctx context.Context, job string, segment int, cursor string, done bool) error {
+	table := s.service.Table(s.TableName(ctx))
+
+	err := table.Put(dbCheckpoint{
+		Projector: job,
+		Subject:   segmentSubject(segment),
+		Cursor:    cursor,
+		Done:      done,
+		UpdatedAt: time.Now(),
+	}).RunWithContext(ctx)
+	if err != nil {
+		return CheckpointError{
+			Err:       ErrCouldNotSaveCheckpoint,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// Reset removes the checkpoint of the projector, to rebuild its projection
+// from the start. It also removes the progress of a job with the name.
+func (s *CheckpointStore) Reset(ctx context.Context, projector string) error {
+	table := s.service.Table(s.TableName(ctx))
+
+	var records []dbCheckpoint
+	err := table.Get("Projector", projector).Project("Projector", "Subject").Consistent(true).AllWithContext(ctx, &records)
+	if err != nil && err != dynamo.ErrNotFound {
+		return CheckpointError{
+			Err:       ErrCouldNotSaveCheckpoint,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	} else if len(records) == 0 {
+		return nil
+	}
+
+	keys := make([]dynamo.Keyed, len(records))
+	for i, r := range records {
+		keys[i] = dynamo.Keys{r.Projector, r.Subject}
+	}
+	if _, err := table.Batch("Projector", "Subject").Write().Delete(keys...).RunWithContext(ctx); err != nil {
+		return CheckpointError{
+			Err:       ErrCouldNotSaveCheckpoint,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// CreateTable creates the table if it is not already existing and correct.
+func (s *CheckpointStore) CreateTable(ctx context.Context) error {
+	if err := s.service.CreateTable(s.TableName(ctx), dbCheckpoint{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.TableName(ctx)),
+	}
+	if err := s.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteTable deletes the checkpoint table.
+func (s *CheckpointStore) DeleteTable(ctx context.Context) error {
+	table := s.service.Table(s.TableName(ctx))
+	err := table.DeleteTable().Run()
+	if err != nil {
+		if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ResourceNotFoundException" {
+			return nil
+		}
+		return ErrCouldNotClearDB
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.TableName(ctx)),
+	}
+	if err := s.service.Client().WaitUntilTableNotExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TableName appends the namespace, if one is set, to the table prefix to
+// get the name of the table to use.
+func (s *CheckpointStore) TableName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.config.TablePrefix + "_" + ns
+}
+
+// dbCheckpoint is a position of a projector, either the global position or
+// the version of one aggregate, or the progress of a job segment.
+type dbCheckpoint struct {
+	Projector string `dynamo:",hash"`
+	Subject   string `dynamo:",range"`
+
+	Position  int64
+	UpdatedAt time.Time
+
+	// Cursor and Done are the progress of a job segment.
+	Cursor string `dynamo:",omitempty"`
+	Done   bool   `dynamo:",omitempty"`
+}
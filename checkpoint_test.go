@@ -0,0 +1,112 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CheckpointStoreTestSuite struct {
+	suite.Suite
+	ctx   context.Context
+	store *CheckpointStore
+}
+
+// SetupTest will create the store and tables
+func (suite *CheckpointStoreTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewCheckpointStore(&CheckpointStoreConfig{Endpoint: os.Getenv("DYNAMODB_HOST")})
+	assert.Nil(suite.T(), err, "there should be no error")
+
+	suite.ctx = eh.NewContextWithNamespace(context.Background(), "ns")
+
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+	assert.Nil(suite.T(), suite.store.CreateTable(suite.ctx), "could not create table")
+}
+
+// TearDownTest will delete the tables
+func (suite *CheckpointStoreTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+	assert.Nil(suite.T(), suite.store.DeleteTable(suite.ctx), "could not delete table")
+}
+
+func (suite *CheckpointStoreTestSuite) TestPosition() {
+	ctx := context.Background()
+
+	cp, err := suite.store.Load(ctx, "projector")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &Checkpoint{Versions: map[uuid.UUID]int{}}, cp)
+
+	assert.Nil(suite.T(), suite.store.SetPosition(ctx, "projector", 0, 10))
+	assert.Nil(suite.T(), suite.store.SetPosition(ctx, "projector", 10, 20))
+
+	err = suite.store.SetPosition(ctx, "projector", 10, 30)
+	if cpErr, ok := err.(CheckpointError); !ok || cpErr.Err != ErrCheckpointConflict {
+		suite.T().Error("there should be a conflict error:", err)
+	}
+
+	cp, err = suite.store.Load(ctx, "projector")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(20), cp.Position)
+
+	// Other namespaces are separate.
+	cp, err = suite.store.Load(suite.ctx, "projector")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), cp.Position)
+}
+
+func (suite *CheckpointStoreTestSuite) TestVersions() {
+	ctx := context.Background()
+	id1, id2 := uuid.New(), uuid.New()
+
+	assert.Nil(suite.T(), suite.store.SetVersion(ctx, "projector", id1, 0, 1))
+	assert.Nil(suite.T(), suite.store.SetVersion(ctx, "projector", id1, 1, 3))
+	assert.Nil(suite.T(), suite.store.SetVersion(ctx, "projector", id2, 0, 2))
+
+	err := suite.store.SetVersion(ctx, "projector", id2, 0, 1)
+	if cpErr, ok := err.(CheckpointError); !ok || cpErr.Err != ErrCheckpointConflict {
+		suite.T().Error("there should be a conflict error:", err)
+	}
+
+	cp, err := suite.store.Load(ctx, "projector")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), map[uuid.UUID]int{id1: 3, id2: 2}, cp.Versions)
+
+	// Reset the projector, but not others.
+	assert.Nil(suite.T(), suite.store.SetPosition(ctx, "projector", 0, 5))
+	assert.Nil(suite.T(), suite.store.SetPosition(ctx, "other", 0, 5))
+	assert.Nil(suite.T(), suite.store.Reset(ctx, "projector"))
+
+	cp, err = suite.store.Load(ctx, "projector")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &Checkpoint{Versions: map[uuid.UUID]int{}}, cp)
+	cp, err = suite.store.Load(ctx, "other")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(5), cp.Position)
+
+	assert.Nil(suite.T(), suite.store.SetVersion(ctx, "projector", id1, 0, 1))
+}
+
+// TestCheckpointStoreTestSuite starts the test suite
+func TestCheckpointStoreTestSuite(t *testing.T) {
+	suite.Run(t, new(CheckpointStoreTestSuite))
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsdynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	dynamodb "github.com/seedboxtech/eh-dynamo"
+)
+
+// parseFlags parses the flags of a command and checks the number of
+// remaining arguments.
+func parseFlags(flags *flag.FlagSet, args []string, nargs int) error {
+	flags.SetOutput(io.Discard)
+	if err := flags.Parse(args); err != nil || flags.NArg() != nargs {
+		return errUsage
+	}
+	return nil
+}
+
+func createTable(ctx context.Context, env *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if err := env.store.CreateTable(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(env.out, "created", env.store.TableName(ctx))
+	return nil
+}
+
+func deleteTable(ctx context.Context, env *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	if err := env.store.DeleteTable(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(env.out, "deleted", env.store.TableName(ctx))
+	return nil
+}
+
+// verifyEvents verifies the stored events, it does not check the table
+// configuration.
+func verifyEvents(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("verify-events", flag.ContinueOnError)
+	aggregate := flags.String("aggregate", "", "")
+	dataless := flags.String("dataless", "", "")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+
+	config := &dynamodb.VerifierConfig{}
+	for _, t := range splitList(*dataless) {
+		config.DatalessEventTypes = append(config.DatalessEventTypes, eh.EventType(t))
+	}
+	verifier := dynamodb.NewVerifier(env.store, config)
+	var report *dynamodb.VerifyReport
+	if *aggregate != "" {
+		id, err := uuid.Parse(*aggregate)
+		if err != nil {
+			return err
+		}
+		if report, err = verifier.VerifyAggregate(ctx, id); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if report, err = verifier.Verify(ctx); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(env.out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	if !report.Valid() {
+		return fmt.Errorf("%d issues found", len(report.Issues))
+	}
+	return nil
+}
+
+func verifyChain(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("verify-chain", flag.ContinueOnError)
+	aggregate := flags.String("aggregate", "", "")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if !env.config.Integrity {
+		return fmt.Errorf("hash chains are not enabled, see -integrity")
+	}
+
+	breaks := []dynamodb.IntegrityBreak{}
+	if *aggregate != "" {
+		id, err := uuid.Parse(*aggregate)
+		if err != nil {
+			return err
+		}
+		b, err := env.store.VerifyChain(ctx, id)
+		if err != nil {
+			return err
+		} else if b != nil {
+			breaks = append(breaks, *b)
+		}
+	} else {
+		var err error
+		if breaks, err = env.store.VerifyChains(ctx); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(env.out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(breaks); err != nil {
+		return err
+	}
+	if len(breaks) > 0 {
+		return fmt.Errorf("%d broken hash chains found", len(breaks))
+	}
+	return nil
+}
+
+func namespaces(ctx context.Context, env *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	tables, err := env.db.ListTables().AllWithContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The table name of the empty namespace is the prefix of all namespaces.
+	prefix := env.store.TableName(eh.NewContextWithNamespace(ctx, ""))
+	var names []string
+	for _, table := range tables {
+		if strings.HasPrefix(table, prefix) && table != prefix {
+			names = append(names, strings.TrimPrefix(table, prefix))
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(env.out, name)
+	}
+	return nil
+}
+
+func dump(ctx context.Context, env *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	id, err := uuid.Parse(args[0])
+	if err != nil {
+		return err
+	}
+
+	events, err := env.store.Load(ctx, id)
+	if err != nil {
+		return err
+	}
+	return dynamodb.ExportEvents(env.out, events)
+}
+
+func tail(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	since := flags.Duration("since", time.Hour, "")
+	n := flags.Int("n", 20, "")
+	follow := flags.Bool("follow", false, "")
+	interval := flags.Duration("interval", 5*time.Second, "")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	if *follow && !env.config.TimeIndex {
+		return fmt.Errorf("-follow needs the time index, see -time-index")
+	}
+
+	from := time.Now().Add(-*since)
+	for {
+		to := time.Now()
+		events, err := recentEvents(ctx, env, from, to)
+		if err != nil {
+			return err
+		}
+		if !*follow && len(events) > *n {
+			events = events[len(events)-*n:]
+		}
+		if err := dynamodb.ExportEvents(env.out, events); err != nil {
+			return err
+		}
+		if !*follow {
+			return nil
+		}
+
+		from = to
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// recentEvents loads the events saved from and until to, sorted by
+// timestamp. Without the time index all events are loaded.
+func recentEvents(ctx context.Context, env *env, from, to time.Time) ([]eh.Event, error) {
+	if env.config.TimeIndex {
+		return env.store.LoadByTimeRange(ctx, from, to)
+	}
+
+	all, err := env.store.LoadAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var events []eh.Event
+	for _, e := range all {
+		if !e.Timestamp().Before(from) && e.Timestamp().Before(to) {
+			events = append(events, e)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp().Before(events[j].Timestamp())
+	})
+	return events, nil
+}
+
+func rename(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("rename", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "")
+	job := flags.String("job", "", "")
+	if err := parseFlags(flags, args, 2); err != nil {
+		return err
+	}
+	from, to := eh.EventType(flags.Arg(0)), eh.EventType(flags.Arg(1))
+
+	progress, err := env.store.RenameEventJob(ctx, from, to, &dynamodb.RenameEventConfig{
+		JobID:  *job,
+		DryRun: *dryRun,
+		OnProgress: func(p dynamodb.RenameEventProgress) {
+			fmt.Fprintf(os.Stderr, "scanned %d, matched %d, renamed %d\r", p.Scanned, p.Matched, p.Renamed)
+		},
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(env.out, "scanned %d, matched %d, renamed %d, skipped %d\n",
+		progress.Scanned, progress.Matched, progress.Renamed, progress.Skipped)
+	return nil
+}
+
+func migrate(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	id := flags.String("id", "", "")
+	eventTypes := flags.String("event-types", "", "")
+	aggregateTypes := flags.String("aggregate-types", "", "")
+	target := flags.String("target", "", "")
+	drop := flags.Bool("drop", false, "")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	// Without a target only dropping events changes anything.
+	if *id == "" || (*target == "" && !*drop) {
+		return errUsage
+	}
+
+	migration := &dynamodb.Migration{
+		ID:                *id,
+		TargetTablePrefix: *target,
+		Transform: func(ctx context.Context, event eh.Event) (eh.Event, error) {
+			if *drop {
+				return nil, nil
+			}
+			return event, nil
+		},
+	}
+	for _, t := range splitList(*eventTypes) {
+		migration.EventTypes = append(migration.EventTypes, eh.EventType(t))
+	}
+	for _, t := range splitList(*aggregateTypes) {
+		migration.AggregateTypes = append(migration.AggregateTypes, eh.AggregateType(t))
+	}
+
+	migrator, err := newMigrator(ctx, env)
+	if err != nil {
+		return err
+	}
+	results, err := migrator.Run(ctx, migration)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.AlreadyApplied {
+			fmt.Fprintf(env.out, "%s already applied\n", r.ID)
+			continue
+		}
+		fmt.Fprintf(env.out, "%s: scanned %d, transformed %d, dropped %d, copied %d, skipped %d\n",
+			r.ID, r.Scanned, r.Transformed, r.Dropped, r.Copied, r.Skipped)
+	}
+	return nil
+}
+
+func migrations(ctx context.Context, env *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	migrator, err := newMigrator(ctx, env)
+	if err != nil {
+		return err
+	}
+	ids, err := migrator.Applied(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		fmt.Fprintln(env.out, id)
+	}
+	return nil
+}
+
+func unlockMigration(ctx context.Context, env *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	migrator, err := newMigrator(ctx, env)
+	if err != nil {
+		return err
+	}
+	return migrator.Unlock(ctx, args[0])
+}
+
+// newMigrator returns a migrator, creating its table if needed.
+func newMigrator(ctx context.Context, env *env) (*dynamodb.Migrator, error) {
+	migrator := dynamodb.NewMigrator(env.store, nil)
+	err := migrator.CreateTable(ctx)
+	if err, ok := err.(awserr.Error); ok && err.Code() == awsdynamodb.ErrCodeResourceInUseException {
+		return migrator, nil
+	}
+	return migrator, err
+}
+
+func export(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "", "")
+	eventTypes := flags.String("event-types", "", "")
+	aggregateTypes := flags.String("aggregate-types", "", "")
+	from := flags.String("from", "", "")
+	to := flags.String("to", "", "")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+
+	filter := &dynamodb.ExportFilter{}
+	for _, t := range splitList(*eventTypes) {
+		filter.EventTypes = append(filter.EventTypes, eh.EventType(t))
+	}
+	for _, t := range splitList(*aggregateTypes) {
+		filter.AggregateTypes = append(filter.AggregateTypes, eh.AggregateType(t))
+	}
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return err
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return err
+		}
+	}
+
+	if *output == "" {
+		return env.store.Export(ctx, env.out, filter)
+	}
+
+	// Errors writing the file can be returned by Close.
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := env.store.Export(ctx, f, filter); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importEvents(ctx context.Context, env *env, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := flags.String("i", "", "")
+	if err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+
+	r := os.Stdin
+	if *input != "" {
+		var err error
+		if r, err = os.Open(*input); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+
+	result, err := env.store.Import(ctx, r)
+	for _, c := range result.Conflicts {
+		fmt.Fprintf(os.Stderr, "conflict: %s %s@%d already exists\n", c.EventType, c.AggregateID, c.Version)
+	}
+	fmt.Fprintf(env.out, "imported %d, conflicts %d\n", result.Imported, len(result.Conflicts))
+	return err
+}
+
+func stats(ctx context.Context, env *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	tables := []string{env.store.TableName(ctx)}
+	if env.config.Idempotency {
+		tables = append(tables, env.store.IdempotencyTableName(ctx))
+	}
+	if env.config.AggregateSummaries {
+		tables = append(tables, env.store.AggregateTableName(ctx))
+	}
+	if env.config.AuditLog {
+		tables = append(tables, env.store.AuditTableName(ctx))
+	}
+
+	// Item counts and sizes are updated by DynamoDB about every six hours.
+	w := tabwriter.NewWriter(env.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSTATUS\tITEMS\tBYTES\tSTREAM\tCREATED")
+	for _, name := range tables {
+		desc, err := env.db.Table(name).Describe().RunWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%t\t%s\n", desc.Name, desc.Status, desc.Items, desc.Size,
+			desc.StreamEnabled, desc.Created.Format(time.RFC3339))
+		for _, index := range desc.GSI {
+			fmt.Fprintf(w, "  %s\t%s\t%d\t%d\t\t\n", index.Name, index.Status, index.Items, index.Size)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	dynamodb "github.com/seedboxtech/eh-dynamo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CommandsTestSuite struct {
+	suite.Suite
+	env *env
+	ctx context.Context
+	out *bytes.Buffer
+}
+
+// SetupTest will create the event table with the create-table command
+func (suite *CommandsTestSuite) SetupTest() {
+	var err error
+	suite.env, err = newEnv(&dynamodb.EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	}, eh.DefaultNamespace)
+	assert.Nil(suite.T(), err, "there should be no error")
+	suite.out = &bytes.Buffer{}
+	suite.env.out = suite.out
+
+	suite.ctx = eh.NewContextWithNamespace(context.Background(), suite.env.namespace)
+	assert.Nil(suite.T(), createTable(suite.ctx, suite.env, nil), "could not create table")
+}
+
+// TearDownTest will delete the table with the delete-table command
+func (suite *CommandsTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), deleteTable(suite.ctx, suite.env, nil), "could not delete table")
+}
+
+func (suite *CommandsTestSuite) TestExportImport() {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	err := suite.env.store.Save(suite.ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, id, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	dir, err := os.MkdirTemp("", "ehdynamo")
+	assert.Nil(suite.T(), err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "events.ndjson")
+
+	assert.Nil(suite.T(), export(suite.ctx, suite.env, []string{"-o", file}))
+	assert.Nil(suite.T(), verifyEvents(suite.ctx, suite.env, nil))
+
+	// Import the events into an empty table.
+	assert.Nil(suite.T(), deleteTable(suite.ctx, suite.env, nil))
+	assert.Nil(suite.T(), createTable(suite.ctx, suite.env, nil))
+	assert.Nil(suite.T(), importEvents(suite.ctx, suite.env, []string{"-i", file}))
+
+	events, err := suite.env.store.Load(suite.ctx, id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 2) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event2"}, events[1].Data())
+	}
+
+	// A failing export returns the error.
+	assert.NotNil(suite.T(), export(suite.ctx, suite.env, []string{"-o", filepath.Join(dir, "missing", "events.ndjson")}))
+	assert.Equal(suite.T(), errUsage, export(suite.ctx, suite.env, []string{"extra"}))
+}
+
+// saveEvents saves two events of a new aggregate.
+func (suite *CommandsTestSuite) saveEvents(timestamp time.Time) uuid.UUID {
+	id := uuid.New()
+	err := suite.env.store.Save(suite.ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventOtherType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, id, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	return id
+}
+
+// lines returns the lines printed by the commands so far and clears them.
+func (suite *CommandsTestSuite) lines() []string {
+	defer suite.out.Reset()
+	return strings.Split(strings.TrimSuffix(suite.out.String(), "\n"), "\n")
+}
+
+func (suite *CommandsTestSuite) TestDump() {
+	id := suite.saveEvents(time.Now())
+	suite.saveEvents(time.Now())
+
+	assert.Nil(suite.T(), dump(suite.ctx, suite.env, []string{id.String()}))
+	lines := suite.lines()
+	if assert.Len(suite.T(), lines, 2) {
+		assert.Contains(suite.T(), lines[0], id.String())
+		assert.Contains(suite.T(), lines[1], string(mocks.EventOtherType))
+	}
+
+	assert.Equal(suite.T(), errUsage, dump(suite.ctx, suite.env, nil))
+	assert.NotNil(suite.T(), dump(suite.ctx, suite.env, []string{"invalid"}))
+}
+
+func (suite *CommandsTestSuite) TestTail() {
+	suite.saveEvents(time.Now().Add(-2 * time.Hour))
+	id := suite.saveEvents(time.Now())
+
+	// Only the events since an hour ago are printed, the last n of them.
+	assert.Nil(suite.T(), tail(suite.ctx, suite.env, nil))
+	lines := suite.lines()
+	if assert.Len(suite.T(), lines, 2) {
+		assert.Contains(suite.T(), lines[0], id.String())
+		assert.Contains(suite.T(), lines[1], id.String())
+	}
+	assert.Nil(suite.T(), tail(suite.ctx, suite.env, []string{"-since", "3h", "-n", "3"}))
+	assert.Len(suite.T(), suite.lines(), 3)
+
+	// Following needs the time index.
+	assert.NotNil(suite.T(), tail(suite.ctx, suite.env, []string{"-follow"}))
+}
+
+func (suite *CommandsTestSuite) TestRename() {
+	id := suite.saveEvents(time.Now())
+
+	assert.Nil(suite.T(), rename(suite.ctx, suite.env, []string{"-dry-run", string(mocks.EventOtherType), "Renamed"}))
+	assert.Equal(suite.T(), []string{"scanned 2, matched 1, renamed 0, skipped 0"}, suite.lines())
+
+	assert.Nil(suite.T(), rename(suite.ctx, suite.env, []string{string(mocks.EventOtherType), "Renamed"}))
+	assert.Equal(suite.T(), []string{"scanned 2, matched 1, renamed 1, skipped 0"}, suite.lines())
+	events, err := suite.env.store.Load(suite.ctx, id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 2) {
+		assert.Equal(suite.T(), eh.EventType("Renamed"), events[1].EventType())
+	}
+
+	assert.Equal(suite.T(), errUsage, rename(suite.ctx, suite.env, []string{"Renamed"}))
+}
+
+func (suite *CommandsTestSuite) TestMigrate() {
+	id := suite.saveEvents(time.Now())
+	migrator := dynamodb.NewMigrator(suite.env.store, nil)
+	defer func() {
+		assert.Nil(suite.T(), migrator.DeleteTable(suite.ctx))
+	}()
+
+	// Drop the last event of the aggregate in place.
+	migrationID := "drop-" + id.String()
+	args := []string{"-id", migrationID, "-event-types", string(mocks.EventOtherType), "-drop"}
+	assert.Nil(suite.T(), migrate(suite.ctx, suite.env, args))
+	assert.Equal(suite.T(), []string{
+		fmt.Sprintf("%s: scanned 2, transformed 0, dropped 1, copied 0, skipped 0", migrationID),
+	}, suite.lines())
+	events, err := suite.env.store.Load(suite.ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 1)
+
+	assert.Nil(suite.T(), migrate(suite.ctx, suite.env, args))
+	assert.Equal(suite.T(), []string{migrationID + " already applied"}, suite.lines())
+	assert.Nil(suite.T(), migrations(suite.ctx, suite.env, nil))
+	assert.Equal(suite.T(), []string{migrationID}, suite.lines())
+
+	// Without a target only dropping is allowed.
+	assert.Equal(suite.T(), errUsage, migrate(suite.ctx, suite.env, []string{"-id", "copy"}))
+}
+
+// TestCommandsTestSuite starts the test suite
+func TestCommandsTestSuite(t *testing.T) {
+	suite.Run(t, new(CommandsTestSuite))
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command ehdynamo operates a DynamoDB event store: creating and deleting
+// tables, inspecting events and running maintenance jobs.
+//
+// Usage:
+//
+//	ehdynamo [flags] <command> [command flags] [args]
+//
+// The endpoint, region, table prefix and namespace are set with flags or the
+// DYNAMODB_HOST, AWS_REGION, EH_TABLE_PREFIX and EH_NAMESPACE environment
+// variables. The key of the hash chains is read from EH_INTEGRITY_KEY, to
+// keep it out of the process list. Credentials are read as by the AWS SDK,
+// any credentials work with DynamoDB Local:
+//
+//	AWS_ACCESS_KEY_ID=x AWS_SECRET_ACCESS_KEY=x ehdynamo -endpoint http://localhost:8000 stats
+//
+// Run ehdynamo without arguments for the list of commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+	dynamodb "github.com/seedboxtech/eh-dynamo"
+)
+
+// errUsage is when a command is used with the wrong arguments, the usage of
+// the command is printed instead of the error.
+var errUsage = errors.New("usage")
+
+// env is the config from the global flags.
+type env struct {
+	db        *dynamo.DB
+	store     *dynamodb.EventStore
+	config    *dynamodb.EventStoreConfig
+	namespace string
+	// out is where the commands print their output.
+	out io.Writer
+}
+
+// command is a sub command.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+var commands = map[string]command{
+	"create-table":     {"", "create the tables of the namespace", createTable},
+	"delete-table":     {"", "delete the tables of the namespace", deleteTable},
+	"verify-events":    {"[-aggregate id] [-dataless t,...]", "verify the events, not the table configuration, and print a JSON report", verifyEvents},
+	"verify-chain":     {"[-aggregate id]", "verify the hash chains and print the broken links as JSON", verifyChain},
+	"namespaces":       {"", "list the namespaces with an event table", namespaces},
+	"dump":             {"<aggregate id>", "print the events of an aggregate as NDJSON", dump},
+	"tail":             {"[-since d] [-n count] [-follow]", "print recent events as NDJSON", tail},
+	"rename":           {"[-dry-run] [-job id] <from> <to>", "rename an event type", rename},
+	"migrate":          {"-id id [-event-types t,...] [-aggregate-types t,...] [-target prefix] [-drop]", "copy or drop events with a migration", migrate},
+	"migrations":       {"", "list the applied migrations", migrations},
+	"unlock-migration": {"<id>", "unlock an interrupted migration", unlockMigration},
+	"export":           {"[-o file] [-event-types t,...] [-aggregate-types t,...] [-from t] [-to t]", "export events as NDJSON", export},
+	"import":           {"[-i file]", "import events from NDJSON", importEvents},
+	"stats":            {"", "print table statistics", stats},
+}
+
+func main() {
+	config := &dynamodb.EventStoreConfig{}
+	flags := flag.NewFlagSet("ehdynamo", flag.ExitOnError)
+	flags.StringVar(&config.Endpoint, "endpoint", os.Getenv("DYNAMODB_HOST"), "DynamoDB endpoint, for example http://localhost:8000 for DynamoDB Local")
+	flags.StringVar(&config.Region, "region", os.Getenv("AWS_REGION"), "AWS region")
+	flags.StringVar(&config.TablePrefix, "prefix", os.Getenv("EH_TABLE_PREFIX"), "event table prefix")
+	namespace := flags.String("namespace", envOr("EH_NAMESPACE", eh.DefaultNamespace), "namespace")
+	flags.BoolVar(&config.TimeIndex, "time-index", false, "the time index is enabled")
+	flags.BoolVar(&config.EventTypeIndex, "event-type-index", false, "the event type index is enabled")
+	flags.BoolVar(&config.AggregateTypeIndex, "aggregate-type-index", false, "the aggregate type index is enabled")
+	flags.BoolVar(&config.Idempotency, "idempotency", false, "idempotency keys are enabled")
+	flags.BoolVar(&config.AggregateSummaries, "summaries", false, "aggregate summaries are enabled")
+	flags.BoolVar(&config.AuditLog, "audit", false, "the audit log is enabled")
+	flags.BoolVar(&config.Integrity, "integrity", false, "hash chains are enabled")
+	integritySince := flags.String("integrity-since", "", "when hash chains were enabled, as RFC 3339, older events can have no hash")
+	retention := flags.String("retention", "", "retention of aggregate types, for example Order=720h,Cart=24h")
+	flags.Usage = func() { usage(flags) }
+	flags.Parse(os.Args[1:])
+
+	var err error
+	if config.Retention, err = parseRetention(*retention); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		usage(flags)
+		os.Exit(2)
+	}
+	if key := os.Getenv("EH_INTEGRITY_KEY"); key != "" {
+		config.IntegrityKey = []byte(key)
+	}
+	if *integritySince != "" {
+		if config.IntegritySince, err = time.Parse(time.RFC3339, *integritySince); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	if flags.NArg() == 0 {
+		usage(flags)
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		usage(flags)
+		os.Exit(2)
+	}
+
+	// Any defaults of the store config are set when creating it.
+	env, err := newEnv(config, *namespace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(eh.NewContextWithNamespace(context.Background(), env.namespace))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	if err := cmd.run(ctx, env, flags.Args()[1:]); err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: ehdynamo %s %s\n", name, cmd.usage)
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func newEnv(config *dynamodb.EventStoreConfig, namespace string) (*env, error) {
+	awsConfig := &aws.Config{}
+	if config.Region != "" {
+		awsConfig.Region = aws.String(config.Region)
+	} else {
+		awsConfig.Region = aws.String("us-east-1")
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	db := dynamo.New(sess)
+	return &env{
+		db:        db,
+		store:     dynamodb.NewEventStoreWithDB(config, db),
+		config:    config,
+		namespace: namespace,
+		out:       os.Stdout,
+	}, nil
+}
+
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "usage: ehdynamo [flags] <command> [command flags] [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-17s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flags.PrintDefaults()
+}
+
+func envOr(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+// splitList splits a comma separated list, an empty string is an empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// parseRetention parses a comma separated list of aggregate type=duration
+// pairs, an empty string is no retention.
+func parseRetention(s string) (map[eh.AggregateType]time.Duration, error) {
+	var retention map[eh.AggregateType]time.Duration
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid retention %q, expected type=duration", pair)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention %q: %s", pair, err)
+		}
+		if retention == nil {
+			retention = map[eh.AggregateType]time.Duration{}
+		}
+		retention[eh.AggregateType(parts[0])] = d
+	}
+	return retention, nil
+}
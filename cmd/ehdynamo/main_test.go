@@ -0,0 +1,59 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	eh "github.com/looplab/eventhorizon"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitList(t *testing.T) {
+	assert.Nil(t, splitList(""))
+	assert.Equal(t, []string{"a", "b"}, splitList("a,b"))
+}
+
+func TestParseFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "")
+	assert.Nil(t, parseFlags(flags, []string{"-dry-run", "a", "b"}, 2))
+	assert.True(t, *dryRun)
+
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	assert.Equal(t, errUsage, parseFlags(flags, []string{"a"}, 2))
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	assert.Equal(t, errUsage, parseFlags(flags, []string{"-unknown"}, 0))
+}
+
+func TestParseRetention(t *testing.T) {
+	retention, err := parseRetention("")
+	assert.Nil(t, err)
+	assert.Nil(t, retention)
+
+	retention, err = parseRetention("Order=720h,Cart=30m")
+	assert.Nil(t, err)
+	assert.Equal(t, map[eh.AggregateType]time.Duration{
+		"Order": 720 * time.Hour,
+		"Cart":  30 * time.Minute,
+	}, retention)
+
+	for _, s := range []string{"Order", "=1h", "Order=forever"} {
+		_, err = parseRetention(s)
+		assert.NotNil(t, err, s)
+	}
+}
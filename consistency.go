@@ -0,0 +1,55 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+)
+
+// Consistency is the read consistency used when reading from DynamoDB.
+type Consistency int
+
+// The read consistencies. Strongly consistent reads always see all prior
+// writes, eventually consistent reads cost half as much but may be stale.
+const (
+	StrongConsistency Consistency = iota
+	EventualConsistency
+)
+
+type consistencyContextKey int
+
+const consistencyKey consistencyContextKey = iota
+
+// NewContextWithConsistency returns the context with a read consistency set,
+// overriding the read consistency of the config for all reads using it.
+func NewContextWithConsistency(ctx context.Context, c Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey, c)
+}
+
+// ConsistencyFromContext returns the read consistency from the context, if
+// one is set.
+func ConsistencyFromContext(ctx context.Context) (Consistency, bool) {
+	c, ok := ctx.Value(consistencyKey).(Consistency)
+	return c, ok
+}
+
+// consistentRead returns if a read should be strongly consistent, using the
+// context before the configured read consistency.
+func consistentRead(ctx context.Context, configured Consistency) bool {
+	if c, ok := ConsistencyFromContext(ctx); ok {
+		return c == StrongConsistency
+	}
+	return configured == StrongConsistency
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistentRead(t *testing.T) {
+	ctx := context.Background()
+	assert.True(t, consistentRead(ctx, StrongConsistency))
+	assert.False(t, consistentRead(ctx, EventualConsistency))
+
+	_, ok := ConsistencyFromContext(ctx)
+	assert.False(t, ok)
+
+	ctx = NewContextWithConsistency(ctx, EventualConsistency)
+	c, ok := ConsistencyFromContext(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, EventualConsistency, c)
+	assert.False(t, consistentRead(ctx, StrongConsistency))
+
+	ctx = NewContextWithConsistency(ctx, StrongConsistency)
+	assert.True(t, consistentRead(ctx, EventualConsistency))
+}
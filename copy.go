@@ -0,0 +1,308 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrSameNamespace is when a namespace is copied to itself.
+var ErrSameNamespace = errors.New("same namespace")
+
+// ErrSplittingFilter is when a copy filter selects events by event type or
+// time, which would copy only some of the events of an aggregate.
+var ErrSplittingFilter = errors.New("filter would copy partial aggregates")
+
+// CopyNamespaceOptions are the options of CopyNamespace.
+type CopyNamespaceOptions struct {
+	// Filter selects the events to copy, defaults to all events. Only the
+	// aggregate types can be set, so that whole aggregates are copied.
+	Filter *ExportFilter
+	// MapAggregateID maps the aggregate IDs of the copied events, and the IDs
+	// of copied repo items that are UUIDs. It must return the same new ID for
+	// the same ID every time, also when the copy is resumed. The hashes of
+	// mapped events are kept, which breaks their hash chains.
+	MapAggregateID func(uuid.UUID) uuid.UUID
+	// RepoTables maps the names of repo tables to copy to the names of the
+	// copies, which must exist. Repo tables are not namespaced, so the names
+	// are used as is.
+	RepoTables map[string]string
+
+	// JobID identifies the copy in the progress store, defaults to
+	// "copy/<from>/<to>".
+	JobID string
+	// Progress stores the progress of the copy, defaults to an in-memory
+	// store which can not resume the copy after a restart. Use a
+	// CheckpointStore to resume interrupted copies.
+	Progress JobProgressStore
+	// Segments is the number of table segments scanned in parallel, defaults
+	// to 4.
+	Segments int
+	// PageSize is the max number of items scanned per page, defaults to 100.
+	PageSize int
+}
+
+func (o *CopyNamespaceOptions) provideDefaults(from, to string) {
+	if o.Filter == nil {
+		o.Filter = &ExportFilter{}
+	}
+	if o.JobID == "" {
+		o.JobID = fmt.Sprintf("copy/%s/%s", from, to)
+	}
+	if o.Progress == nil {
+		o.Progress = NewMemoryJobProgressStore()
+	}
+	if o.Segments == 0 {
+		o.Segments = 4
+	}
+	if o.PageSize == 0 {
+		o.PageSize = 100
+	}
+}
+
+// CopyNamespaceResult is the result of CopyNamespace. The copy counts are
+// for the current run only, items copied before a resume are counted as
+// skipped if scanned again.
+type CopyNamespaceResult struct {
+	// Scanned is the number of scanned events.
+	Scanned int64
+	// Copied is the number of copied events.
+	Copied int64
+	// Skipped is the number of selected events that already existed in the
+	// target namespace.
+	Skipped int64
+	// RepoItemsCopied and RepoItemsSkipped are the numbers of copied repo
+	// items and of repo items that already existed in the copy.
+	RepoItemsCopied  int64
+	RepoItemsSkipped int64
+
+	// SourceEvents and TargetEvents are the number of selected events in the
+	// source namespace and the number of events in the target namespace,
+	// counted after the copy. They are equal when the target namespace only
+	// has the copied events and no events were saved during the copy.
+	SourceEvents int64
+	TargetEvents int64
+}
+
+// CopyNamespace copies the events of a namespace to another namespace, and
+// optionally repo tables, for example to create a staging tenant from a
+// production tenant. Only whole aggregates are copied, filters by event type
+// or time are refused with ErrSplittingFilter. The event table of the target namespace is created if
+// it does not exist. Events are copied as stored, with their versions, and
+// are not overwritten if they exist in the target. Idempotency keys, audit
+// logs and aggregate summaries are not copied. The progress is saved after
+// every page, so that an interrupted copy continues where it stopped when run
+// again with the same job ID and progress store. The progress of the events
+// and of every repo table is cleared once it is copied, so that copying again
+// later copies the new events and items.
+func (s *EventStore) CopyNamespace(ctx context.Context, from, to string, options *CopyNamespaceOptions) (CopyNamespaceResult, error) {
+	var result CopyNamespaceResult
+	if from == to {
+		return result, eh.EventStoreError{
+			Err:       ErrSameNamespace,
+			Namespace: from,
+		}
+	}
+	if options == nil {
+		options = &CopyNamespaceOptions{}
+	}
+	if f := options.Filter; f != nil && (len(f.EventTypes) > 0 || !f.From.IsZero() || !f.To.IsZero()) {
+		return result, eh.EventStoreError{
+			Err:       ErrSplittingFilter,
+			Namespace: from,
+		}
+	}
+	options.provideDefaults(from, to)
+
+	fromCtx := eh.NewContextWithNamespace(ctx, from)
+	toCtx := eh.NewContextWithNamespace(ctx, to)
+	copyError := func(err error) error {
+		if _, ok := err.(eh.EventStoreError); ok {
+			return err
+		}
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: to,
+		}
+	}
+
+	if err := s.createNamespace(toCtx); err != nil {
+		return result, copyError(err)
+	}
+
+	scan := &segmentScan{
+		job:           options.JobID,
+		segments:      options.Segments,
+		pageSize:      int64(options.PageSize),
+		progress:      options.Progress,
+		clearWhenDone: true,
+	}
+	target := s.service.Table(s.TableName(toCtx))
+	var mu sync.Mutex
+	err := s.runSegmentScan(fromCtx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		var copied, skipped int64
+		for _, e := range page {
+			if !options.Filter.matches(&e) {
+				continue
+			}
+
+			if options.MapAggregateID != nil {
+				e.AggregateID = options.MapAggregateID(e.AggregateID)
+			}
+			s.setDBEventAttributes(&e)
+			err := target.Put(e).
+				If("attribute_not_exists(AggregateID) AND attribute_not_exists(Version)").
+				RunWithContext(ctx)
+			if isConditionalCheckFailed(err) {
+				skipped++
+			} else if err != nil {
+				return err
+			} else {
+				copied++
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		result.Scanned += scanned
+		result.Copied += copied
+		result.Skipped += skipped
+		return nil
+	})
+	if err != nil {
+		return result, copyError(err)
+	}
+
+	for source, dest := range options.RepoTables {
+		if err := s.copyRepoTable(fromCtx, source, dest, options, &result); err != nil {
+			return result, copyError(err)
+		}
+	}
+
+	if result.SourceEvents, err = s.countEvents(fromCtx, options.Filter, options.Segments); err != nil {
+		return result, copyError(err)
+	}
+	if result.TargetEvents, err = s.countEvents(toCtx, nil, options.Segments); err != nil {
+		return result, copyError(err)
+	}
+
+	return result, nil
+}
+
+// createNamespace creates the event table of a namespace if it does not
+// exist.
+func (s *EventStore) createNamespace(ctx context.Context) error {
+	_, err := s.service.Table(s.TableName(ctx)).Describe().RunWithContext(ctx)
+	if err, ok := err.(awserr.RequestFailure); ok && err.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		return s.CreateTable(ctx)
+	}
+	return err
+}
+
+// copyRepoTable copies the items of a repo table, with the progress saved
+// after every page and cleared when all items are copied.
+func (s *EventStore) copyRepoTable(ctx context.Context, source, dest string, options *CopyNamespaceOptions, result *CopyNamespaceResult) error {
+	job := options.JobID + "/repo/" + source
+	cursor, done, err := options.Progress.LoadProgress(ctx, job, 0)
+	if err != nil || done {
+		return err
+	}
+
+	client := s.service.Client()
+	for {
+		startKey, err := decodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+
+		output, err := client.ScanWithContext(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(source),
+			Limit:             aws.Int64(int64(options.PageSize)),
+			ExclusiveStartKey: startKey,
+			ConsistentRead:    aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, item := range output.Items {
+			if options.MapAggregateID != nil && item["ID"] != nil {
+				if id, err := uuid.Parse(aws.StringValue(item["ID"].S)); err == nil {
+					item["ID"] = &dynamodb.AttributeValue{S: aws.String(options.MapAggregateID(id).String())}
+				}
+			}
+			_, err := client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+				TableName:           aws.String(dest),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(ID)"),
+			})
+			if isConditionalCheckFailed(err) {
+				result.RepoItemsSkipped++
+			} else if err != nil {
+				return err
+			} else {
+				result.RepoItemsCopied++
+			}
+		}
+
+		// An empty cursor of the last page clears the progress.
+		if cursor, err = encodeCursor(dynamo.PagingKey(output.LastEvaluatedKey)); err != nil {
+			return err
+		}
+		if err := options.Progress.SaveProgress(ctx, job, 0, cursor, false); err != nil {
+			return err
+		}
+		if cursor == "" {
+			return nil
+		}
+	}
+}
+
+// countEvents counts the events of the namespace in the context selected by
+// the filter, or all events if it is nil.
+func (s *EventStore) countEvents(ctx context.Context, filter *ExportFilter, segments int) (int64, error) {
+	var count int64
+	var mu sync.Mutex
+	scan := &segmentScan{
+		segments: segments,
+		pageSize: 1000,
+	}
+	err := s.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		var n int64
+		for _, e := range page {
+			if filter == nil || filter.matches(&e) {
+				n++
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		count += n
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CopyNamespaceTestSuite struct {
+	suite.Suite
+	store *EventStore
+	ids   []uuid.UUID
+}
+
+// SetupTest will create the source table with events
+func (suite *CopyNamespaceTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+
+	ctx := eh.NewContextWithNamespace(context.Background(), "prod")
+	assert.Nil(suite.T(), suite.store.CreateTable(ctx), "could not create table")
+
+	suite.ids = nil
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		id := uuid.New()
+		suite.ids = append(suite.ids, id)
+		aggregateType := mocks.AggregateType
+		if i%2 == 1 {
+			aggregateType = "Other"
+		}
+		err := suite.store.Save(ctx, []eh.Event{
+			eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+				timestamp, aggregateType, id, 1),
+			eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+				timestamp, aggregateType, id, 2),
+		}, 0)
+		assert.Nil(suite.T(), err)
+	}
+}
+
+// TearDownTest will delete the tables
+func (suite *CopyNamespaceTestSuite) TearDownTest() {
+	for _, ns := range []string{"prod", "staging"} {
+		ctx := eh.NewContextWithNamespace(context.Background(), ns)
+		assert.Nil(suite.T(), suite.store.DeleteTable(ctx), "could not delete table")
+	}
+}
+
+func (suite *CopyNamespaceTestSuite) TestCopy() {
+	mapped := map[uuid.UUID]uuid.UUID{}
+	for _, id := range suite.ids {
+		mapped[id] = uuid.New()
+	}
+	options := &CopyNamespaceOptions{
+		Filter: &ExportFilter{
+			AggregateTypes: []eh.AggregateType{mocks.AggregateType},
+		},
+		MapAggregateID: func(id uuid.UUID) uuid.UUID { return mapped[id] },
+		Segments:       2,
+		PageSize:       3,
+	}
+
+	result, err := suite.store.CopyNamespace(context.Background(), "prod", "staging", options)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(8), result.Scanned)
+	assert.Equal(suite.T(), int64(4), result.Copied)
+	assert.Equal(suite.T(), int64(4), result.SourceEvents)
+	assert.Equal(suite.T(), int64(4), result.TargetEvents)
+
+	ctx := eh.NewContextWithNamespace(context.Background(), "staging")
+	events, err := suite.store.Load(ctx, mapped[suite.ids[0]])
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 2) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event2"}, events[1].Data())
+	}
+	events, err = suite.store.Load(ctx, mapped[suite.ids[1]])
+	assert.Nil(suite.T(), err)
+	assert.Empty(suite.T(), events)
+
+	// A new job skips the events that are already copied.
+	options.JobID = "again"
+	options.Progress = nil
+	result, err = suite.store.CopyNamespace(context.Background(), "prod", "staging", options)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), result.Copied)
+	assert.Equal(suite.T(), int64(4), result.Skipped)
+
+	// The progress is cleared when done, so running the job again copies the
+	// new events.
+	err = suite.store.Save(eh.NewContextWithNamespace(context.Background(), "prod"), []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			time.Now(), mocks.AggregateType, suite.ids[0], 3),
+	}, 2)
+	assert.Nil(suite.T(), err)
+	result, err = suite.store.CopyNamespace(context.Background(), "prod", "staging", options)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), result.Copied)
+	assert.Equal(suite.T(), int64(4), result.Skipped)
+}
+
+// TestCopyNamespaceTestSuite starts the test suite
+func TestCopyNamespaceTestSuite(t *testing.T) {
+	suite.Run(t, new(CopyNamespaceTestSuite))
+}
+
+func TestCopyNamespaceSame(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	_, err := store.CopyNamespace(context.Background(), "prod", "prod", nil)
+	if esErr, ok := err.(eh.EventStoreError); assert.True(t, ok) {
+		assert.Equal(t, ErrSameNamespace, esErr.Err)
+	}
+}
+
+func TestCopyNamespaceSplittingFilter(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	for _, filter := range []*ExportFilter{
+		{EventTypes: []eh.EventType{mocks.EventType}},
+		{From: time.Now()},
+		{To: time.Now()},
+	} {
+		_, err := store.CopyNamespace(context.Background(), "prod", "staging", &CopyNamespaceOptions{
+			Filter: filter,
+		})
+		if esErr, ok := err.(eh.EventStoreError); assert.True(t, ok) {
+			assert.Equal(t, ErrSplittingFilter, esErr.Err)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotCorrect is when a batch of corrected events could not be
+// written, for example because an event was already corrected with the same
+// correction ID or was changed concurrently.
+var ErrCouldNotCorrect = errors.New("could not correct events")
+
+// ErrInvalidBatchSize is when the batch size of a Corrector is not positive
+// or its transactions would have more than MaxTxItems writes.
+var ErrInvalidBatchSize = errors.New("invalid batch size")
+
+// CorrectionSelector selects the events to correct. All set fields must
+// match, an empty selector selects all events.
+type CorrectionSelector struct {
+	// AggregateIDs are the aggregates to correct events of.
+	AggregateIDs []uuid.UUID
+	// EventType is the event type to correct.
+	EventType eh.EventType
+	// From and To is the time window of the events to correct, from and
+	// including From up to but not including To.
+	From, To time.Time
+}
+
+// matches returns true if the event is selected.
+func (s *CorrectionSelector) matches(e *dbEvent) bool {
+	if s.EventType != "" && e.EventType != s.EventType {
+		return false
+	}
+	if !s.From.IsZero() && e.Timestamp.Before(s.From) {
+		return false
+	}
+	if !s.To.IsZero() && !e.Timestamp.Before(s.To) {
+		return false
+	}
+	return true
+}
+
+// CorrectionResult is the result of a correction.
+type CorrectionResult struct {
+	// Matched is the number of selected events.
+	Matched int64
+	// Corrected is the number of corrected events.
+	Corrected int64
+	// Skipped is the number of selected events that were already corrected
+	// with the correction ID, by an earlier run.
+	Skipped int64
+}
+
+// CorrectorConfig is a config for the Corrector.
+type CorrectorConfig struct {
+	// TablePrefix is the prefix of the history table, defaults to
+	// "eventhorizonCorrections".
+	TablePrefix string
+	// BatchSize is the number of events corrected per transaction, defaults
+	// to 10. Every event uses two, or three with the audit log, of the
+	// MaxTxItems writes of a transaction, larger batches fail with
+	// ErrInvalidBatchSize.
+	BatchSize int
+	// Segments is the number of table segments scanned in parallel when no
+	// aggregate IDs are selected, defaults to 4.
+	Segments int
+}
+
+func (c *CorrectorConfig) provideDefaults() {
+	if c.TablePrefix == "" {
+		c.TablePrefix = "eventhorizonCorrections"
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 8
+	}
+	if c.Segments == 0 {
+		c.Segments = 4
+	}
+}
+
+// Corrector corrects stored events in bulk. Every corrected event is
+// written in the same transaction as a copy of the original event in a
+// history table per namespace, so that a correction can be rolled back, and
+// the audit log record if enabled.
+type Corrector struct {
+	store  *EventStore
+	config *CorrectorConfig
+}
+
+// NewCorrector creates a new Corrector for the event store.
+func NewCorrector(store *EventStore, config *CorrectorConfig) *Corrector {
+	if config == nil {
+		config = &CorrectorConfig{}
+	}
+	config.provideDefaults()
+
+	return &Corrector{
+		store:  store,
+		config: config,
+	}
+}
+
+// Correct corrects the selected events with fn, which returns the corrected
+// event or nil to leave the event unchanged. A corrected event must keep the
+// aggregate ID, version, event type and aggregate type of the event, as for
+// Replace. The correction ID identifies the correction in the history and
+// can only be used once per event, events already corrected with it are
+// skipped. On error the batches that were written stay corrected, and can be
+// rolled back or completed by running the correction again.
+func (c *Corrector) Correct(ctx context.Context, id string, selector *CorrectionSelector, fn func(context.Context, eh.Event) (eh.Event, error)) (CorrectionResult, error) {
+	var result CorrectionResult
+	if err := c.checkBatchSize(ctx); err != nil {
+		return result, err
+	}
+	if selector == nil {
+		selector = &CorrectionSelector{}
+	}
+
+	var mu sync.Mutex
+	correct := func(ctx context.Context, page []dbEvent) error {
+		var selected []dbEvent
+		for _, e := range page {
+			if selector.matches(&e) {
+				selected = append(selected, e)
+			}
+		}
+
+		for len(selected) > 0 {
+			n := c.config.BatchSize
+			if n > len(selected) {
+				n = len(selected)
+			}
+			corrected, skipped, err := c.correctBatch(ctx, id, selected[:n], fn)
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			result.Matched += int64(n)
+			result.Corrected += corrected
+			result.Skipped += skipped
+			mu.Unlock()
+			selected = selected[n:]
+		}
+		return nil
+	}
+
+	var err error
+	if len(selector.AggregateIDs) > 0 {
+		table := c.store.service.Table(c.store.TableName(ctx))
+		for _, aggregateID := range selector.AggregateIDs {
+			var page []dbEvent
+			err = table.Get("AggregateID", aggregateID.String()).Consistent(true).AllWithContext(ctx, &page)
+			if err == dynamo.ErrNotFound {
+				continue
+			} else if err != nil {
+				break
+			}
+			if err = correct(ctx, page); err != nil {
+				break
+			}
+		}
+	} else {
+		scan := &segmentScan{
+			segments: c.config.Segments,
+			pageSize: 100,
+		}
+		err = c.store.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+			return correct(ctx, page)
+		})
+	}
+	if err != nil {
+		if _, ok := err.(eh.EventStoreError); ok {
+			return result, err
+		}
+		return result, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotCorrect,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return result, nil
+}
+
+// checkBatchSize returns ErrInvalidBatchSize if the transactions of a batch
+// would be empty or too large.
+func (c *Corrector) checkBatchSize(ctx context.Context) error {
+	writes := 2
+	if c.store.config.AuditLog {
+		writes = 3
+	}
+	if c.config.BatchSize < 1 || c.config.BatchSize*writes > MaxTxItems {
+		return eh.EventStoreError{
+			BaseErr:   fmt.Errorf("%d events of %d writes", c.config.BatchSize, writes),
+			Err:       ErrInvalidBatchSize,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	return nil
+}
+
+// correctBatch corrects a batch of events in one transaction and returns
+// the number of corrected events and of events that were already corrected.
+func (c *Corrector) correctBatch(ctx context.Context, id string, batch []dbEvent, fn func(context.Context, eh.Event) (eh.Event, error)) (int64, int64, error) {
+	history := c.store.service.Table(c.TableName(ctx))
+
+	// Skip the events corrected by an earlier run of the correction.
+	keys := make([]dynamo.Keyed, len(batch))
+	for i, e := range batch {
+		keys[i] = dynamo.Keys{id, correctionSubject(e.AggregateID, e.Version)}
+	}
+	var done []dbCorrection
+	err := history.Batch("CorrectionID", "Subject").Get(keys...).Consistent(true).AllWithContext(ctx, &done)
+	if err != nil && err != dynamo.ErrNotFound {
+		return 0, 0, err
+	}
+	corrected := map[string]bool{}
+	for _, r := range done {
+		corrected[r.Subject] = true
+	}
+	var remaining []dbEvent
+	for _, e := range batch {
+		if !corrected[correctionSubject(e.AggregateID, e.Version)] {
+			remaining = append(remaining, e)
+		}
+	}
+	skipped := int64(len(batch) - len(remaining))
+	batch = remaining
+
+	events, err := c.store.buildEvents(ctx, batch)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tx := c.store.NewTx()
+	now := time.Now()
+	var corrections int64
+	for i, event := range events {
+		corrected, err := fn(ctx, event)
+		if err != nil {
+			return 0, 0, err
+		} else if corrected == nil {
+			continue
+		}
+		if corrected.AggregateID() != event.AggregateID() || corrected.Version() != event.Version() {
+			return 0, 0, eh.EventStoreError{
+				BaseErr:   fmt.Errorf("%s of %s changed key", event, event.AggregateID()),
+				Err:       ErrEventMismatch,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		record, err := c.store.newDBEvent(ctx, corrected)
+		if err != nil {
+			return 0, 0, err
+		}
+		put := c.store.replacePut(ctx, record)
+		// Only correct the event if it is unchanged since it was read.
+		item, err := dynamo.MarshalItem(batch[i])
+		if err != nil {
+			return 0, 0, err
+		}
+		cond, args := unchangedCondition(item)
+		tx.put(fmt.Sprintf("correct %s of %s", event, event.AggregateID()), put.If(cond, args...))
+		tx.put(fmt.Sprintf("save history of %s of %s", event, event.AggregateID()), history.Put(dbCorrection{
+			CorrectionID: id,
+			Subject:      correctionSubject(event.AggregateID(), event.Version()),
+			Original:     batch[i],
+			Corrected:    *record,
+			CorrectedAt:  now,
+		}).If("attribute_not_exists(CorrectionID)"))
+		if put := c.store.auditPut(ctx, AuditCorrect, &batch[i]); put != nil {
+			tx.put(fmt.Sprintf("audit %s of %s", event, event.AggregateID()), put)
+		}
+		corrections++
+	}
+
+	if corrections == 0 {
+		return 0, skipped, nil
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotCorrect,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return corrections, skipped, nil
+}
+
+// Rollback restores the original events of a correction and returns the
+// number of restored events. A rolled back correction is removed from the
+// history. Events that were changed after the correction are not restored,
+// the batch with such an event fails with ErrCouldNotCorrect. The audit log
+// records the corrected event as the previous event.
+func (c *Corrector) Rollback(ctx context.Context, id string) (int64, error) {
+	if err := c.checkBatchSize(ctx); err != nil {
+		return 0, err
+	}
+
+	history := c.store.service.Table(c.TableName(ctx))
+
+	var records []dbCorrection
+	err := history.Get("CorrectionID", id).Consistent(true).AllWithContext(ctx, &records)
+	if err != nil && err != dynamo.ErrNotFound {
+		return 0, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	table := c.store.service.Table(c.store.TableName(ctx))
+	var restored int64
+	for len(records) > 0 {
+		n := c.config.BatchSize
+		if n > len(records) {
+			n = len(records)
+		}
+
+		tx := c.store.NewTx()
+		for _, r := range records[:n] {
+			original := r.Original
+			item, err := dynamo.MarshalItem(r.Corrected)
+			if err != nil {
+				return restored, eh.EventStoreError{
+					BaseErr:   err,
+					Err:       err,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+			cond, args := unchangedCondition(item)
+			tx.put(fmt.Sprintf("restore %s@%d", original.AggregateID, original.Version),
+				table.Put(original).If(cond, args...))
+			tx.delete(fmt.Sprintf("remove history of %s@%d", original.AggregateID, original.Version),
+				history.Delete("CorrectionID", r.CorrectionID).Range("Subject", r.Subject))
+			if put := c.store.auditPut(ctx, AuditRollback, &r.Corrected); put != nil {
+				tx.put(fmt.Sprintf("audit restore %s@%d", original.AggregateID, original.Version), put)
+			}
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return restored, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotCorrect,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		restored += int64(n)
+		records = records[n:]
+	}
+
+	return restored, nil
+}
+
+// CreateTable creates the history table if it is not already existing and
+// correct.
+func (c *Corrector) CreateTable(ctx context.Context) error {
+	if err := c.store.service.CreateTable(c.TableName(ctx), dbCorrection{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(c.TableName(ctx)),
+	}
+	if err := c.store.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteTable deletes the history table.
+func (c *Corrector) DeleteTable(ctx context.Context) error {
+	return c.store.deleteTable(c.TableName(ctx))
+}
+
+// TableName appends the namespace, if one is set, to the table prefix to
+// get the name of the table to use.
+func (c *Corrector) TableName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return c.config.TablePrefix + "_" + ns
+}
+
+// correctionSubject is the range key of a corrected event in the history.
+func correctionSubject(id uuid.UUID, version int) string {
+	return fmt.Sprintf("%s/%d", id, version)
+}
+
+// dbCorrection is the original and corrected image of a corrected event.
+type dbCorrection struct {
+	CorrectionID string `dynamo:",hash"`
+	Subject      string `dynamo:",range"`
+
+	Original    dbEvent
+	Corrected   dbEvent
+	CorrectedAt time.Time
+}
+
+// unchangedCondition returns the condition that all attributes of an item
+// have the same values as when it was read.
+func unchangedCondition(item map[string]*dynamodb.AttributeValue) (string, []interface{}) {
+	names := make([]string, 0, len(item))
+	for name := range item {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conds := make([]string, len(names))
+	args := make([]interface{}, 0, 2*len(names))
+	for i, name := range names {
+		conds[i] = "$ = ?"
+		args = append(args, name, item[name])
+	}
+	return strings.Join(conds, " AND "), args
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type CorrectorTestSuite struct {
+	suite.Suite
+	store     *EventStore
+	corrector *Corrector
+	ids       []uuid.UUID
+}
+
+// SetupTest will create the event and history tables
+func (suite *CorrectorTestSuite) SetupTest() {
+	var err error
+	prefix := "eventhorizonTest_" + uuid.New().String()
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: prefix,
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+
+	suite.corrector = NewCorrector(suite.store, &CorrectorConfig{
+		TablePrefix: prefix + "_corrections",
+		BatchSize:   2,
+	})
+	assert.Nil(suite.T(), suite.corrector.CreateTable(context.Background()), "could not create history table")
+
+	suite.ids = nil
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		id := uuid.New()
+		suite.ids = append(suite.ids, id)
+		err := suite.store.Save(context.Background(), []eh.Event{
+			eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "wrong"},
+				timestamp, mocks.AggregateType, id, 1),
+			eh.NewEventForAggregate(mocks.EventOtherType, &mocks.EventData{Content: "right"},
+				timestamp.Add(time.Hour), mocks.AggregateType, id, 2),
+		}, 0)
+		assert.Nil(suite.T(), err)
+	}
+}
+
+// TearDownTest will delete the tables
+func (suite *CorrectorTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.corrector.DeleteTable(context.Background()), "could not delete history table")
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func fixContent(ctx context.Context, event eh.Event) (eh.Event, error) {
+	data, ok := event.Data().(*mocks.EventData)
+	if !ok || data.Content != "wrong" {
+		return nil, nil
+	}
+	return eh.NewEventForAggregate(event.EventType(), &mocks.EventData{Content: "fixed"},
+		event.Timestamp(), event.AggregateType(), event.AggregateID(), event.Version()), nil
+}
+
+func (suite *CorrectorTestSuite) contents(id uuid.UUID) []string {
+	events, err := suite.store.Load(context.Background(), id)
+	assert.Nil(suite.T(), err)
+	var contents []string
+	for _, e := range events {
+		contents = append(contents, e.Data().(*mocks.EventData).Content)
+	}
+	return contents
+}
+
+func (suite *CorrectorTestSuite) TestCorrectAndRollback() {
+	ctx := context.Background()
+
+	result, err := suite.corrector.Correct(ctx, "fix", &CorrectionSelector{
+		EventType: mocks.EventType,
+	}, fixContent)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), CorrectionResult{Matched: 5, Corrected: 5}, result)
+	for _, id := range suite.ids {
+		assert.Equal(suite.T(), []string{"fixed", "right"}, suite.contents(id))
+	}
+
+	// Running the correction again skips the corrected events, so that a
+	// failed run can be completed.
+	result, err = suite.corrector.Correct(ctx, "fix", nil, fixContent)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), CorrectionResult{Matched: 10, Skipped: 5}, result)
+
+	restored, err := suite.corrector.Rollback(ctx, "fix")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(5), restored)
+	for _, id := range suite.ids {
+		assert.Equal(suite.T(), []string{"wrong", "right"}, suite.contents(id))
+	}
+
+	// Nothing is left to roll back.
+	restored, err = suite.corrector.Rollback(ctx, "fix")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(0), restored)
+}
+
+func (suite *CorrectorTestSuite) TestRollbackChanged() {
+	ctx := context.Background()
+
+	_, err := suite.corrector.Correct(ctx, "fix", &CorrectionSelector{
+		AggregateIDs: suite.ids[:1],
+	}, fixContent)
+	assert.Nil(suite.T(), err)
+
+	// An event changed after the correction is not restored.
+	events, err := suite.store.Load(ctx, suite.ids[0])
+	assert.Nil(suite.T(), err)
+	err = suite.store.Replace(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "changed"},
+		events[0].Timestamp(), mocks.AggregateType, suite.ids[0], 1))
+	assert.Nil(suite.T(), err)
+
+	_, err = suite.corrector.Rollback(ctx, "fix")
+	if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != ErrCouldNotCorrect {
+		suite.T().Error("there should be a could not correct error:", err)
+	}
+	assert.Equal(suite.T(), []string{"changed", "right"}, suite.contents(suite.ids[0]))
+}
+
+func (suite *CorrectorTestSuite) TestCorrectAggregates() {
+	ctx := context.Background()
+
+	result, err := suite.corrector.Correct(ctx, "fix", &CorrectionSelector{
+		AggregateIDs: suite.ids[:2],
+	}, fixContent)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), CorrectionResult{Matched: 4, Corrected: 2}, result)
+	assert.Equal(suite.T(), []string{"fixed", "right"}, suite.contents(suite.ids[0]))
+	assert.Equal(suite.T(), []string{"wrong", "right"}, suite.contents(suite.ids[2]))
+}
+
+func (suite *CorrectorTestSuite) TestCorrectChangedKey() {
+	_, err := suite.corrector.Correct(context.Background(), "fix", &CorrectionSelector{
+		AggregateIDs: suite.ids[:1],
+	}, func(ctx context.Context, event eh.Event) (eh.Event, error) {
+		return eh.NewEventForAggregate(event.EventType(), event.Data(),
+			event.Timestamp(), event.AggregateType(), event.AggregateID(), event.Version()+10), nil
+	})
+	if esErr, ok := err.(eh.EventStoreError); assert.True(suite.T(), ok) {
+		assert.Equal(suite.T(), ErrEventMismatch, esErr.Err)
+	}
+}
+
+// TestCorrectorTestSuite starts the test suite
+func TestCorrectorTestSuite(t *testing.T) {
+	suite.Run(t, new(CorrectorTestSuite))
+}
+
+func TestCorrectionSelector(t *testing.T) {
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	e := &dbEvent{EventType: mocks.EventType, Timestamp: timestamp}
+
+	assert.True(t, (&CorrectionSelector{}).matches(e))
+	assert.True(t, (&CorrectionSelector{EventType: mocks.EventType}).matches(e))
+	assert.False(t, (&CorrectionSelector{EventType: mocks.EventOtherType}).matches(e))
+	assert.True(t, (&CorrectionSelector{From: timestamp, To: timestamp.Add(time.Second)}).matches(e))
+	assert.False(t, (&CorrectionSelector{From: timestamp.Add(time.Second)}).matches(e))
+	assert.False(t, (&CorrectionSelector{To: timestamp}).matches(e))
+}
+
+func TestCorrectorBatchSize(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{AuditLog: true}, nil)
+
+	// Three writes per event with the audit log.
+	for _, size := range []int{-1, MaxTxItems/3 + 1} {
+		c := NewCorrector(store, &CorrectorConfig{BatchSize: size})
+		_, err := c.Correct(context.Background(), "fix", nil, fixContent)
+		if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != ErrInvalidBatchSize {
+			t.Error("there should be an invalid batch size error:", err)
+		}
+		_, err = c.Rollback(context.Background(), "fix")
+		if esErr, ok := err.(eh.EventStoreError); !ok || esErr.Err != ErrInvalidBatchSize {
+			t.Error("there should be an invalid batch size error:", err)
+		}
+	}
+}
+
+func TestUnchangedCondition(t *testing.T) {
+	cond, args := unchangedCondition(map[string]*dynamodb.AttributeValue{
+		"Version":   {N: aws.String("1")},
+		"EventType": {S: aws.String("Event")},
+	})
+	assert.Equal(t, "$ = ? AND $ = ?", cond)
+	assert.Equal(t, []interface{}{
+		"EventType", &dynamodb.AttributeValue{S: aws.String("Event")},
+		"Version", &dynamodb.AttributeValue{N: aws.String("1")},
+	}, args)
+}
@@ -25,6 +25,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
 	"github.com/google/uuid"
 	"github.com/guregu/dynamo"
 	eh "github.com/looplab/eventhorizon"
@@ -42,17 +44,111 @@ var ErrCouldNotUnmarshalEvent = errors.New("could not unmarshal event")
 // ErrCouldNotSaveAggregate is when an aggregate could not be saved.
 var ErrCouldNotSaveAggregate = errors.New("could not save aggregate")
 
+// ErrEventVersionNotFound is when an event is replaced but the aggregate has
+// no event with its version. It is the same error as eh.ErrInvalidEvent, as
+// expected by the eventhorizon.EventStoreMaintainer interface.
+var ErrEventVersionNotFound = eh.ErrInvalidEvent
+
+// ErrEventMismatch is when an event is replaced by an event with another
+// event type or aggregate type.
+var ErrEventMismatch = errors.New("event mismatch")
+
 // EventStoreConfig is a config for the DynamoDB event store.
 type EventStoreConfig struct {
 	TablePrefix string
 	Region      string
 	Endpoint    string
+
+	// ReadConsistency is the consistency of Load and LoadAll, defaults to
+	// strongly consistent reads. It can be overridden per call with
+	// NewContextWithConsistency.
+	ReadConsistency Consistency
+
+	// Idempotency enables saving events with an idempotency key from
+	// NewContextWithIdempotencyKey, recorded in a separate table per
+	// namespace with IdempotencyTablePrefix, defaults to
+	// "eventhorizonIdempotency". Keys expire after IdempotencyTTL, defaults
+	// to 24 hours.
+	Idempotency            bool
+	IdempotencyTablePrefix string
+	IdempotencyTTL         time.Duration
+
+	// TimeIndex enables LoadByTimeRange with a global secondary index on the
+	// event timestamps, partitioned in buckets of TimeBucketSize, defaults to
+	// one hour. The bucket size can not be changed once events are saved.
+	TimeIndex      bool
+	TimeBucketSize time.Duration
+
+	// EventTypeIndex and AggregateTypeIndex enable LoadByEventType and
+	// LoadByAggregateType with global secondary indexes on the event type
+	// and aggregate type, sorted by timestamp.
+	EventTypeIndex     bool
+	AggregateTypeIndex bool
+
+	// AggregateSummaries enables ListAggregates and AggregateInfo with a
+	// summary record per aggregate, saved in the same transaction as the
+	// events in a separate table per namespace with AggregateTablePrefix,
+	// defaults to "eventhorizonAggregates". A save can then have at most
+	// MaxTxItems-1 events, and an aggregate can only be saved once per Tx,
+	// otherwise Save returns ErrTxTooLarge or ErrTxDuplicateItem. Save and
+	// in place migrations update the summaries, rebuild them with
+	// RebuildAggregateSummaries for events saved before enabling them or
+	// changed by Replace or RenameEvent.
+	AggregateSummaries   bool
+	AggregateTablePrefix string
+
+	// Retention is how long events of an aggregate type are kept, counted
+	// from the event timestamp. Expired events are removed by the TTL of the
+	// table, at some point after they expire, and can be archived with
+	// RunArchiver. Loading such an aggregate returns only its remaining events.
+	Retention map[eh.AggregateType]time.Duration
+
+	// AuditLog enables recording the previous image of events changed by
+	// maintenance operations, with the operator and reason from
+	// NewContextWithAuditInfo, in a separate table per namespace with
+	// AuditTablePrefix, defaults to "eventhorizonAudit". Read it with
+	// AuditLog.
+	AuditLog         bool
+	AuditTablePrefix string
+
+	// Integrity enables a hash chain per aggregate. Every saved event stores
+	// a hash of its content and the hash of the previous event, which is read
+	// before saving. Verify the chains with VerifyChain and VerifyChains.
+	// Replace and Import rebuild the chain of the events they write. Events
+	// changed by RenameEvent, migrations or corrections break the chain,
+	// which makes such changes visible.
+	Integrity bool
+	// IntegrityKey is the secret key of the hashes, which are then
+	// HMAC-SHA256. Without a key anyone who can write to the table can
+	// change events and recompute their hashes. Even with a key the latest
+	// events of an aggregate can be deleted without breaking the chain, keep
+	// the chain heads outside the table to detect it.
+	IntegrityKey []byte
+	// IntegritySince is when integrity was enabled. Only events with an
+	// earlier timestamp are allowed to have no hash, if zero all events must
+	// have one.
+	IntegritySince time.Time
 }
 
 func (c *EventStoreConfig) provideDefaults() {
 	if c.TablePrefix == "" {
 		c.TablePrefix = "eventhorizonEvents"
 	}
+	if c.IdempotencyTablePrefix == "" {
+		c.IdempotencyTablePrefix = "eventhorizonIdempotency"
+	}
+	if c.IdempotencyTTL == 0 {
+		c.IdempotencyTTL = 24 * time.Hour
+	}
+	if c.AggregateTablePrefix == "" {
+		c.AggregateTablePrefix = "eventhorizonAggregates"
+	}
+	if c.AuditTablePrefix == "" {
+		c.AuditTablePrefix = "eventhorizonAudit"
+	}
+	if c.TimeBucketSize == 0 {
+		c.TimeBucketSize = time.Hour
+	}
 	if c.Region == "" {
 		c.Region = "us-east-1"
 	}
@@ -61,6 +157,7 @@ func (c *EventStoreConfig) provideDefaults() {
 // EventStore implements an EventStore for DynamoDB.
 type EventStore struct {
 	service *dynamo.DB
+	streams dynamodbstreamsiface.DynamoDBStreamsAPI
 	config  *EventStoreConfig
 }
 
@@ -78,11 +175,15 @@ func NewEventStore(config *EventStoreConfig) (*EventStore, error) {
 		return nil, err
 	}
 	db := dynamo.New(session)
-	return NewEventStoreWithDB(config, db), nil
+	s := NewEventStoreWithDB(config, db)
+	s.streams = dynamodbstreams.New(session)
+	return s, nil
 }
 
 // NewEventStoreWithDB creates a new EventStore with DB
 func NewEventStoreWithDB(config *EventStoreConfig, db *dynamo.DB) *EventStore {
+	config.provideDefaults()
+
 	s := &EventStore{
 		service: db,
 		config:  config,
@@ -100,11 +201,32 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 		}
 	}
 
+	if key, ok := IdempotencyKeyFromContext(ctx); ok {
+		return s.saveIdempotent(ctx, key, events, originalVersion)
+	}
+
+	// The events and the aggregate summary are saved atomically.
+	if s.config.AggregateSummaries && TxFromContext(ctx) == nil {
+		return s.saveInTx(ctx, events, originalVersion)
+	}
+
 	// Build all event records, with incrementing versions starting from the
 	// original aggregate version.
 	aggregateID := events[0].AggregateID()
 	version := originalVersion
+	var prevHash string
+	if s.config.Integrity {
+		var err error
+		if prevHash, err = s.chainHash(ctx, aggregateID, originalVersion); err != nil {
+			return err
+		}
+	}
 	table := s.service.Table(s.TableName(ctx))
+
+	// The writes of a transaction are only added when all events are valid,
+	// so that a failed save does not leave a partial save to commit.
+	tx := TxFromContext(ctx)
+	var ops []txOp
 	for _, event := range events {
 		// Only accept events belonging to the same aggregate.
 		if event.AggregateID() != aggregateID {
@@ -123,17 +245,32 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 		}
 
 		// Create the event record for the DB.
-		e, err := newDBEvent(ctx, event)
+		e, err := s.newDBEvent(ctx, event)
 		if err != nil {
 			return err
 		}
 		version++
 
+		if s.config.Integrity {
+			e.PrevHash = prevHash
+			e.Hash = eventHash(s.config.IntegrityKey, e)
+			prevHash = e.Hash
+		}
+
 		// TODO: Implement atomic version counter for the aggregate.
 		// TODO: Batch write all events.
 		// TODO: Support translating not found to not be an error but an
 		// empty list.
-		if err := table.Put(e).If("attribute_not_exists(AggregateID) AND attribute_not_exists(Version)").Run(); err != nil {
+		put := table.Put(e).If("attribute_not_exists(AggregateID) AND attribute_not_exists(Version)")
+
+		// Defer the write to the transaction if there is one.
+		if tx != nil {
+			ops = append(ops, putOp(fmt.Sprintf("save event %s of %s in %s", event, aggregateID, table.Name()),
+				fmt.Sprintf("%s/%s/%d", table.Name(), aggregateID, event.Version()), put))
+			continue
+		}
+
+		if err := put.Run(); err != nil {
 			if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ConditionalCheckFailedException" {
 				return eh.EventStoreError{
 					BaseErr:   err,
@@ -149,15 +286,71 @@ func (s *EventStore) Save(ctx context.Context, events []eh.Event, originalVersio
 		}
 	}
 
+	if tx == nil {
+		return nil
+	}
+
+	if s.config.AggregateSummaries {
+		update := s.aggregateSummaryUpdate(ctx, events, originalVersion)
+		ops = append(ops, updateOp(fmt.Sprintf("update summary of %s", aggregateID),
+			s.AggregateTableName(ctx)+"/"+aggregateID.String(), update))
+	}
+	if err := tx.addAll(ops); err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
 	return nil
 }
 
+// saveInTx saves the events in a new transaction which is committed before
+// returning.
+func (s *EventStore) saveInTx(ctx context.Context, events []eh.Event, originalVersion int) error {
+	tx := s.NewTx()
+	if err := s.Save(NewContextWithTx(ctx, tx), events, originalVersion); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return s.saveTxError(ctx, err)
+	}
+
+	return nil
+}
+
+// saveTxError translates an error from committing saved events. Failed
+// conditions are version conflicts.
+func (s *EventStore) saveTxError(ctx context.Context, err error) error {
+	if txErr, ok := err.(TxError); ok && txErr.Err == ErrTxCanceled {
+		for _, r := range txErr.Reasons {
+			if r.Code == "ConditionalCheckFailed" {
+				return eh.EventStoreError{
+					BaseErr:   err,
+					Err:       ErrCouldNotSaveAggregate,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+		}
+	}
+
+	return eh.EventStoreError{
+		BaseErr:   err,
+		Err:       err,
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+}
+
 // Load implements the Load method of the eventhorizon.EventStore interface.
 func (s *EventStore) Load(ctx context.Context, id uuid.UUID) ([]eh.Event, error) {
 	table := s.service.Table(s.TableName(ctx))
 
 	var dbEvents []dbEvent
-	err := table.Get("AggregateID", id.String()).Consistent(true).All(&dbEvents)
+	err := table.Get("AggregateID", id.String()).
+		Consistent(consistentRead(ctx, s.config.ReadConsistency)).
+		All(&dbEvents)
 	if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ResourceNotFoundException" {
 		return []eh.Event{}, nil
 	} else if err != nil {
@@ -176,7 +369,7 @@ func (s *EventStore) LoadAll(ctx context.Context) ([]eh.Event, error) {
 	table := s.service.Table(s.TableName(ctx))
 
 	var dbEvents []dbEvent
-	err := table.Scan().Consistent(true).All(&dbEvents)
+	err := table.Scan().Consistent(consistentRead(ctx, s.config.ReadConsistency)).All(&dbEvents)
 	if err != nil {
 		return nil, eh.EventStoreError{
 			BaseErr:   err,
@@ -214,70 +407,117 @@ func (s *EventStore) buildEvents(ctx context.Context, dbEvents []dbEvent) ([]eh.
 }
 
 // Replace implements the Replace method of the eventhorizon.EventStore interface.
+// The event is replaced with a single conditional write. Only when it fails
+// is the stored event read, to return eh.ErrAggregateNotFound,
+// ErrEventVersionNotFound or ErrEventMismatch. With the audit log enabled the
+// previous event is recorded in the same transaction as the write. With
+// integrity enabled the event is linked to the previous event and the later
+// events are rehashed, events of the aggregate must not be saved meanwhile.
 func (s *EventStore) Replace(ctx context.Context, event eh.Event) error {
-	table := s.service.Table(s.TableName(ctx))
-
-	count, err := table.Get("AggregateID", event.AggregateID().String()).Consistent(true).Count()
+	e, err := s.newDBEvent(ctx, event)
 	if err != nil {
-		return eh.EventStoreError{
-			BaseErr:   err,
-			Err:       err,
-			Namespace: eh.NamespaceFromContext(ctx),
+		return err
+	}
+	if s.config.Integrity {
+		if e.PrevHash, err = s.chainHash(ctx, e.AggregateID, e.Version-1); err != nil {
+			return err
 		}
-	} else if count == 0 {
-		return eh.ErrAggregateNotFound
+		e.Hash = eventHash(s.config.IntegrityKey, e)
 	}
 
-	// Create the event record for the DB.
-	e, err := newDBEvent(ctx, event)
+	replaced, err := s.auditedWrite(ctx, AuditReplace, e.AggregateID, e.Version, s.replacePut(ctx, e))
 	if err != nil {
-		return err
-	}
-
-	if err := table.Put(e).If("attribute_exists(AggregateID) AND attribute_exists(Version)").Run(); err != nil {
-		if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ConditionalCheckFailedException" {
-			return eh.ErrInvalidEvent
-		}
 		return eh.EventStoreError{
 			BaseErr:   err,
 			Err:       err,
 			Namespace: eh.NamespaceFromContext(ctx),
 		}
+	} else if !replaced {
+		return s.replaceError(ctx, event)
+	}
+
+	if s.config.Integrity {
+		if err := s.rehashChain(ctx, e.AggregateID, e.Version, e.Hash); err != nil {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
 	}
 
 	return nil
 }
 
-// RenameEvent implements the RenameEvent method of the eventhorizon.EventStore interface.
-func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) error {
+// replacePut returns the conditional write of a replaced event, which fails
+// if the event does not exist or has another event or aggregate type.
+func (s *EventStore) replacePut(ctx context.Context, e *dbEvent) *dynamo.Put {
 	table := s.service.Table(s.TableName(ctx))
+	return table.Put(e).If("attribute_exists(AggregateID) AND EventType = ? AND AggregateType = ?",
+		e.EventType, e.AggregateType)
+}
 
-	var dbEvents []dbEvent
-	err := table.Scan().Filter("EventType = ?", from).Consistent(true).All(&dbEvents)
-	if err != nil {
-		return eh.EventStoreError{
-			BaseErr:   err,
-			Err:       err,
-			Namespace: eh.NamespaceFromContext(ctx),
-		}
-	}
+// replaceError returns why an event could not be replaced.
+func (s *EventStore) replaceError(ctx context.Context, event eh.Event) error {
+	table := s.service.Table(s.TableName(ctx))
 
-	for _, dbEvent := range dbEvents {
-		if err := table.Update("AggregateID", dbEvent.AggregateID).Range("Version", dbEvent.Version).If("EventType = ?", from).Set("EventType", to).Run(); err != nil {
+	var stored dbEvent
+	err := table.Get("AggregateID", event.AggregateID().String()).
+		Range("Version", dynamo.Equal, event.Version()).
+		Consistent(true).OneWithContext(ctx, &stored)
+	if err == dynamo.ErrNotFound {
+		count, err := table.Get("AggregateID", event.AggregateID().String()).
+			Consistent(true).Limit(1).CountWithContext(ctx)
+		if err != nil {
 			return eh.EventStoreError{
 				BaseErr:   err,
 				Err:       err,
 				Namespace: eh.NamespaceFromContext(ctx),
 			}
+		} else if count == 0 {
+			return eh.ErrAggregateNotFound
+		}
+		return ErrEventVersionNotFound
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
 		}
 	}
 
-	return nil
+	var mismatch string
+	if stored.AggregateType != event.AggregateType() {
+		mismatch = fmt.Sprintf("aggregate type %s, not %s", stored.AggregateType, event.AggregateType())
+	} else if stored.EventType != event.EventType() {
+		mismatch = fmt.Sprintf("event type %s, not %s", stored.EventType, event.EventType())
+	} else {
+		// The event was changed after the write, report it as a mismatch.
+		mismatch = "event changed concurrently"
+	}
+	return eh.EventStoreError{
+		BaseErr:   errors.New(mismatch),
+		Err:       ErrEventMismatch,
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+}
+
+// RenameEvent implements the RenameEvent method of the eventhorizon.EventStore
+// interface. It runs a RenameEventJob with the default config, use it
+// directly to resume interrupted renames.
+func (s *EventStore) RenameEvent(ctx context.Context, from, to eh.EventType) error {
+	_, err := s.RenameEventJob(ctx, from, to, nil)
+	return err
 }
 
 // CreateTable creates the table if it is not already existing and correct.
 func (s *EventStore) CreateTable(ctx context.Context) error {
-	if err := s.service.CreateTable(s.TableName(ctx), dbEvent{}).Run(); err != nil {
+	// Expired events are archived from the stream.
+	createTable := s.service.CreateTable(s.TableName(ctx), dbEvent{})
+	if len(s.config.Retention) > 0 {
+		createTable = createTable.Stream(dynamo.OldImageView)
+	}
+	if err := createTable.Run(); err != nil {
 		return err
 	}
 
@@ -288,12 +528,117 @@ func (s *EventStore) CreateTable(ctx context.Context) error {
 		return err
 	}
 
+	if len(s.config.Retention) > 0 {
+		if err := s.enableTTL(ctx, s.TableName(ctx)); err != nil {
+			return err
+		}
+	}
+
+	if s.config.TimeIndex {
+		if err := s.createIndex(ctx, timeIndex); err != nil {
+			return err
+		}
+	}
+	if s.config.EventTypeIndex {
+		if err := s.createIndex(ctx, eventTypeIndex); err != nil {
+			return err
+		}
+	}
+	if s.config.AggregateTypeIndex {
+		if err := s.createIndex(ctx, aggregateTypeIndex); err != nil {
+			return err
+		}
+	}
+
+	if s.config.Idempotency {
+		if err := s.createIdempotencyTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.config.AggregateSummaries {
+		if err := s.createAggregateTable(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.config.AuditLog {
+		if err := s.createAuditTable(ctx); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// enableTTL enables the TTL of a table on the ExpiresAt attribute.
+func (s *EventStore) enableTTL(ctx context.Context, tableName string) error {
+	ttlParams := &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	}
+	if _, err := s.service.Client().UpdateTimeToLiveWithContext(ctx, ttlParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createIndex adds a global secondary index to the event table and waits
+// until it is active. DynamoDB only allows creating one index at a time.
+func (s *EventStore) createIndex(ctx context.Context, index dynamo.Index) error {
+	table := s.service.Table(s.TableName(ctx))
+	index.ProjectionType = dynamo.AllProjection
+	index.Throughput = dynamo.Throughput{Read: 1, Write: 1}
+	if _, err := table.UpdateTable().CreateIndex(index).RunWithContext(ctx); err != nil {
+		return err
+	}
+
+	for {
+		desc, err := table.Describe().RunWithContext(ctx)
+		if err != nil {
+			return err
+		}
+		for _, idx := range desc.GSI {
+			if idx.Name == index.Name && idx.Status == dynamo.ActiveStatus && !idx.Backfilling {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
 // DeleteTable deletes the event table.
 func (s *EventStore) DeleteTable(ctx context.Context) error {
-	table := s.service.Table(s.TableName(ctx))
+	if s.config.Idempotency {
+		if err := s.deleteTable(s.IdempotencyTableName(ctx)); err != nil {
+			return err
+		}
+	}
+	if s.config.AggregateSummaries {
+		if err := s.deleteTable(s.AggregateTableName(ctx)); err != nil {
+			return err
+		}
+	}
+	if s.config.AuditLog {
+		if err := s.deleteTable(s.AuditTableName(ctx)); err != nil {
+			return err
+		}
+	}
+
+	return s.deleteTable(s.TableName(ctx))
+}
+
+func (s *EventStore) deleteTable(name string) error {
+	table := s.service.Table(name)
 	err := table.DeleteTable().Run()
 	if err != nil {
 		if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ResourceNotFoundException" {
@@ -303,7 +648,7 @@ func (s *EventStore) DeleteTable(ctx context.Context) error {
 	}
 
 	describeParams := &dynamodb.DescribeTableInput{
-		TableName: aws.String(s.TableName(ctx)),
+		TableName: aws.String(name),
 	}
 	if err := s.service.Client().WaitUntilTableNotExists(describeParams); err != nil {
 		return err
@@ -330,6 +675,51 @@ type dbEvent struct {
 	data          eh.EventData
 	Timestamp     time.Time
 	AggregateType eh.AggregateType
+
+	// Attributes of the optional indexes, only set when they are enabled.
+	TimeBucket string `dynamo:",omitempty"`
+	TimeNano   int64  `dynamo:",omitempty"`
+
+	// ExpiresAt is when the event is removed by the TTL of the table, in Unix
+	// seconds, only set for aggregate types with a retention.
+	ExpiresAt int64 `dynamo:",omitempty"`
+
+	// MigrationID is the last migration that changed the event in place.
+	MigrationID string `dynamo:",omitempty"`
+
+	// Hash and PrevHash link the event to the previous event of the
+	// aggregate, only set when integrity is enabled.
+	Hash     string `dynamo:",omitempty"`
+	PrevHash string `dynamo:",omitempty"`
+}
+
+// newDBEvent returns a new dbEvent for an event, with the attributes of the
+// enabled indexes set.
+func (s *EventStore) newDBEvent(ctx context.Context, event eh.Event) (*dbEvent, error) {
+	e, err := newDBEvent(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	s.setDBEventAttributes(e)
+
+	return e, nil
+}
+
+// setDBEventAttributes sets the attributes of the enabled indexes and the
+// retention of an event record.
+func (s *EventStore) setDBEventAttributes(e *dbEvent) {
+	e.ExpiresAt, e.TimeBucket, e.TimeNano = 0, "", 0
+
+	if retention, ok := s.config.Retention[e.AggregateType]; ok {
+		e.ExpiresAt = e.Timestamp.Add(retention).Unix()
+	}
+	if s.config.TimeIndex {
+		e.TimeBucket = timeBucket(e.Timestamp, s.config.TimeBucketSize)
+	}
+	// The sort key of all indexes, events without it are not indexed.
+	if s.config.TimeIndex || s.config.EventTypeIndex || s.config.AggregateTypeIndex {
+		e.TimeNano = e.Timestamp.UnixNano()
+	}
 }
 
 // newDBEvent returns a new dbEvent for an event.
@@ -116,6 +116,34 @@ func (suite *EventStoreTestSuite) TestSaveInvalidAggregateId() {
 	assert.EqualError(suite.T(), err, "invalid event (default)")
 }
 
+// TestReplaceMismatch will replace events with another event or aggregate type
+func (suite *EventStoreTestSuite) TestReplaceMismatch() {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	err := suite.store.Save(context.Background(), []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	err = suite.store.Replace(context.Background(), eh.NewEventForAggregate(mocks.EventOtherType, nil,
+		timestamp, mocks.AggregateType, id, 1))
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrEventMismatch {
+		suite.T().Error("there should be an event mismatch error:", err)
+	}
+
+	err = suite.store.Replace(context.Background(), eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, eh.AggregateType("Other"), id, 1))
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrEventMismatch {
+		suite.T().Error("there should be an event mismatch error:", err)
+	}
+
+	err = suite.store.Replace(context.Background(), eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 2))
+	assert.Equal(suite.T(), ErrEventVersionNotFound, err)
+}
+
 // TestEventStoreTestSuite starts the test suite
 func TestEventStoreTestSuite(t *testing.T) {
 	suite.Run(t, new(EventStoreTestSuite))
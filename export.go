@@ -0,0 +1,330 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotExport is when events could not be exported.
+var ErrCouldNotExport = errors.New("could not export events")
+
+// ErrCouldNotImport is when events could not be imported.
+var ErrCouldNotImport = errors.New("could not import events")
+
+// importBatchSize is the number of events imported per transaction.
+const importBatchSize = 25
+
+// ExportFilter selects the events to export. All set fields must match, a
+// nil filter exports all events.
+type ExportFilter struct {
+	// AggregateTypes are the aggregate types to export.
+	AggregateTypes []eh.AggregateType
+	// EventTypes are the event types to export.
+	EventTypes []eh.EventType
+	// From and To is the time window of the events to export, from and
+	// including From up to but not including To.
+	From, To time.Time
+}
+
+// matches returns true if the event is selected.
+func (f *ExportFilter) matches(e *dbEvent) bool {
+	if len(f.AggregateTypes) > 0 && !containsAggregateType(f.AggregateTypes, e.AggregateType) {
+		return false
+	}
+	if len(f.EventTypes) > 0 && !containsEventType(f.EventTypes, e.EventType) {
+		return false
+	}
+	if !f.From.IsZero() && e.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Timestamp.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// ImportResult is the result of an import.
+type ImportResult struct {
+	// Imported is the number of imported events.
+	Imported int64
+	// Conflicts are the events that were not imported because the aggregate
+	// already has an event with the same version.
+	Conflicts []ImportConflict
+}
+
+// ImportConflict is an event that already exists in the store.
+type ImportConflict struct {
+	AggregateID uuid.UUID
+	Version     int
+	EventType   eh.EventType
+}
+
+// exportEvent is the exported representation of an event. The data of event
+// types that are not registered is kept as DynamoDB attribute values, as not
+// all of them can be represented as JSON.
+type exportEvent struct {
+	jsonEvent
+	RawData map[string]*dynamodb.AttributeValue `json:"raw_data,omitempty"`
+}
+
+// newExportEvent returns the exported representation of an event.
+func newExportEvent(e eh.Event) (*exportEvent, error) {
+	if se, ok := e.(event); ok && se.data == nil && len(se.RawData) > 0 {
+		return &exportEvent{
+			jsonEvent: jsonEvent{
+				EventType:     se.EventType(),
+				AggregateType: se.AggregateType(),
+				AggregateID:   se.AggregateID(),
+				Version:       se.Version(),
+				Timestamp:     se.Timestamp(),
+			},
+			RawData: se.RawData,
+		}, nil
+	}
+
+	record, err := newJSONEvent(e)
+	if err != nil {
+		return nil, err
+	}
+	return &exportEvent{jsonEvent: *record}, nil
+}
+
+// Export writes the events selected by the filter to w as newline delimited
+// JSON, one event per line. The table is read page by page with strongly
+// consistent reads, events are not sorted. The data of event types that are
+// not registered is exported verbatim as DynamoDB attribute values.
+func (s *EventStore) Export(ctx context.Context, w io.Writer, filter *ExportFilter) error {
+	if filter == nil {
+		filter = &ExportFilter{}
+	}
+
+	enc := json.NewEncoder(w)
+	scan := &segmentScan{
+		segments: 1,
+		pageSize: 100,
+	}
+	err := s.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		var selected []dbEvent
+		for _, e := range page {
+			if filter.matches(&e) {
+				selected = append(selected, e)
+			}
+		}
+		events, err := s.buildEvents(ctx, selected)
+		if err != nil {
+			return err
+		}
+
+		return encodeEvents(enc, events)
+	})
+	if err != nil {
+		if _, ok := err.(eh.EventStoreError); ok {
+			return err
+		}
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotExport,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// ExportEvents writes events to w in the format of Export, for example the
+// events of an aggregate from Load.
+func ExportEvents(w io.Writer, events []eh.Event) error {
+	return encodeEvents(json.NewEncoder(w), events)
+}
+
+func encodeEvents(enc *json.Encoder, events []eh.Event) error {
+	for _, event := range events {
+		record, err := newExportEvent(event)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads events written by Export from r and saves them with their
+// versions, in transactions of up to 25 events. Events that already exist
+// are not overwritten but reported as conflicts, all other events are
+// imported. Imported events are not added to aggregate summaries. On error
+// the events imported so far are kept, and importing the same input again
+// reports them as conflicts. With integrity enabled the imported events are
+// hashed and linked to the previous event of their aggregate, in the input
+// or in the table. Events following a conflict are linked to the event in
+// the input, not the stored one.
+func (s *EventStore) Import(ctx context.Context, r io.Reader) (ImportResult, error) {
+	var result ImportResult
+
+	dec := json.NewDecoder(r)
+	batch := make([]*dbEvent, 0, importBatchSize)
+	keys := map[string]bool{}
+	heads := map[uuid.UUID]chainLink{}
+	for n := 1; ; n++ {
+		var record exportEvent
+		if err := dec.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, eh.EventStoreError{
+				BaseErr:   fmt.Errorf("event %d: %s", n, err),
+				Err:       ErrCouldNotImport,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		e, err := s.importDBEvent(ctx, &record)
+		if err != nil {
+			return result, eh.EventStoreError{
+				BaseErr:   fmt.Errorf("event %d: %s", n, err),
+				Err:       ErrCouldNotImport,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		if s.config.Integrity {
+			if err := s.importChain(ctx, e, heads); err != nil {
+				return result, err
+			}
+		}
+
+		// A transaction can only write an item once.
+		key := fmt.Sprintf("%s@%d", e.AggregateID, e.Version)
+		if len(batch) == importBatchSize || keys[key] {
+			if err := s.importBatch(ctx, batch, &result); err != nil {
+				return result, err
+			}
+			batch = batch[:0]
+			keys = map[string]bool{}
+		}
+		batch = append(batch, e)
+		keys[key] = true
+	}
+
+	if err := s.importBatch(ctx, batch, &result); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// importBatch saves a batch of events in a transaction. When events of the
+// batch already exist the transaction is retried without them.
+func (s *EventStore) importBatch(ctx context.Context, batch []*dbEvent, result *ImportResult) error {
+	table := s.service.Table(s.TableName(ctx))
+	for len(batch) > 0 {
+		tx := s.NewTx()
+		for _, e := range batch {
+			tx.put(fmt.Sprintf("import %s@%d", e.AggregateID, e.Version),
+				table.Put(e).If("attribute_not_exists(AggregateID) AND attribute_not_exists(Version)"))
+		}
+
+		err := tx.Commit(ctx)
+		if err == nil {
+			result.Imported += int64(len(batch))
+			return nil
+		}
+
+		var remaining []*dbEvent
+		if txErr, ok := err.(TxError); ok && txErr.Err == ErrTxCanceled {
+			for i, e := range batch {
+				if i < len(txErr.Reasons) && txErr.Reasons[i].Code == "ConditionalCheckFailed" {
+					result.Conflicts = append(result.Conflicts, ImportConflict{
+						AggregateID: e.AggregateID,
+						Version:     e.Version,
+						EventType:   e.EventType,
+					})
+				} else {
+					remaining = append(remaining, e)
+				}
+			}
+		}
+		if len(remaining) == len(batch) {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       ErrCouldNotImport,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		batch = remaining
+	}
+
+	return nil
+}
+
+// importDBEvent returns the event record of an exported event. The data of
+// registered event types is decoded into the event data type, to store it
+// the same way as when saved. Data of other event types is stored as is,
+// exported attribute values are stored verbatim.
+func (s *EventStore) importDBEvent(ctx context.Context, record *exportEvent) (*dbEvent, error) {
+	if record.EventType == "" || record.AggregateID == uuid.Nil || record.Version < 1 {
+		return nil, errors.New("missing event type, aggregate ID or version")
+	}
+
+	var e *dbEvent
+	hasData := len(record.Data) > 0 && string(record.Data) != "null"
+	if data, err := eh.CreateEventData(record.EventType); err == nil {
+		if hasData {
+			if err := json.Unmarshal(record.Data, data); err != nil {
+				return nil, err
+			}
+		} else {
+			data = nil
+		}
+		event := eh.NewEventForAggregate(record.EventType, data, record.Timestamp,
+			record.AggregateType, record.AggregateID, record.Version)
+		if e, err = newDBEvent(ctx, event); err != nil {
+			return nil, err
+		}
+	} else {
+		e = &dbEvent{
+			EventType:     record.EventType,
+			Timestamp:     record.Timestamp,
+			AggregateType: record.AggregateType,
+			AggregateID:   record.AggregateID,
+			Version:       record.Version,
+		}
+		if len(record.RawData) > 0 {
+			e.RawData = record.RawData
+		} else if hasData {
+			var raw map[string]interface{}
+			if err := json.Unmarshal(record.Data, &raw); err != nil {
+				return nil, err
+			}
+			if e.RawData, err = dynamodbattribute.MarshalMap(raw); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s.setDBEventAttributes(e)
+
+	return e, nil
+}
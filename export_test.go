@@ -0,0 +1,191 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ExportTestSuite struct {
+	suite.Suite
+	store  *EventStore
+	target *EventStore
+}
+
+// SetupTest will create the source and target event tables
+func (suite *ExportTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+
+	suite.target, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.target.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the tables
+func (suite *ExportTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+	assert.Nil(suite.T(), suite.target.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *ExportTestSuite) TestExportImport() {
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventOtherType, nil,
+			timestamp, mocks.AggregateType, id, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	var buf bytes.Buffer
+	assert.Nil(suite.T(), suite.store.Export(ctx, &buf, nil))
+	assert.Equal(suite.T(), 2, strings.Count(buf.String(), "\n"))
+
+	var filtered bytes.Buffer
+	assert.Nil(suite.T(), suite.store.Export(ctx, &filtered, &ExportFilter{
+		EventTypes: []eh.EventType{mocks.EventOtherType},
+	}))
+	assert.Equal(suite.T(), 1, strings.Count(filtered.String(), "\n"))
+
+	// The first event conflicts with an event already in the target.
+	err = suite.target.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "other"},
+			timestamp, mocks.AggregateType, id, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	result, err := suite.target.Import(ctx, bytes.NewReader(buf.Bytes()))
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(1), result.Imported)
+	assert.Equal(suite.T(), []ImportConflict{
+		{AggregateID: id, Version: 1, EventType: mocks.EventType},
+	}, result.Conflicts)
+
+	events, err := suite.target.Load(ctx, id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 2) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "other"}, events[0].Data())
+		assert.Equal(suite.T(), mocks.EventOtherType, events[1].EventType())
+		assert.Equal(suite.T(), 2, events[1].Version())
+		assert.True(suite.T(), timestamp.Equal(events[1].Timestamp()))
+	}
+}
+
+// TestExportTestSuite starts the test suite
+func TestExportTestSuite(t *testing.T) {
+	suite.Run(t, new(ExportTestSuite))
+}
+
+func TestImportDBEvent(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	// Registered event data is stored as when saved.
+	event := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	record, err := newExportEvent(event)
+	assert.Nil(t, err)
+	e, err := store.importDBEvent(ctx, record)
+	assert.Nil(t, err)
+	expected, err := newDBEvent(ctx, event)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, e)
+
+	// Unregistered event data is stored as is.
+	e, err = store.importDBEvent(ctx, &exportEvent{jsonEvent: jsonEvent{
+		EventType:     "Unregistered",
+		AggregateType: mocks.AggregateType,
+		AggregateID:   id,
+		Version:       2,
+		Timestamp:     timestamp,
+		Data:          json.RawMessage(`{"name":"a"}`),
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, "a", aws.StringValue(e.RawData["name"].S))
+
+	_, err = store.importDBEvent(ctx, &exportEvent{jsonEvent: jsonEvent{EventType: mocks.EventType}})
+	assert.NotNil(t, err)
+}
+
+func TestExportRawData(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	ctx := context.Background()
+	raw := map[string]*dynamodb.AttributeValue{
+		"Blob":  {B: []byte{0, 1, 254, 255}},
+		"Tags":  {SS: []*string{aws.String("a"), aws.String("b")}},
+		"Sizes": {NS: []*string{aws.String("1"), aws.String("2.5")}},
+		"Big":   {N: aws.String("12345678901234567890123456789")},
+		"Items": {L: []*dynamodb.AttributeValue{{BOOL: aws.Bool(true)}, {NULL: aws.Bool(true)}}},
+	}
+	stored := event{dbEvent: dbEvent{
+		EventType:     "Unregistered",
+		AggregateType: mocks.AggregateType,
+		AggregateID:   uuid.New(),
+		Version:       1,
+		Timestamp:     time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC),
+		RawData:       raw,
+	}}
+
+	// Unregistered event data is exported and imported verbatim.
+	record, err := newExportEvent(stored)
+	assert.Nil(t, err)
+	b, err := json.Marshal(record)
+	assert.Nil(t, err)
+	var decoded exportEvent
+	assert.Nil(t, json.Unmarshal(b, &decoded))
+	assert.Empty(t, decoded.Data)
+	e, err := store.importDBEvent(ctx, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, raw, e.RawData)
+}
+
+func TestExportFilter(t *testing.T) {
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	e := &dbEvent{EventType: mocks.EventType, AggregateType: mocks.AggregateType, Timestamp: timestamp}
+
+	assert.True(t, (&ExportFilter{}).matches(e))
+	assert.True(t, (&ExportFilter{AggregateTypes: []eh.AggregateType{mocks.AggregateType}}).matches(e))
+	assert.False(t, (&ExportFilter{AggregateTypes: []eh.AggregateType{"Other"}}).matches(e))
+	assert.False(t, (&ExportFilter{EventTypes: []eh.EventType{mocks.EventOtherType}}).matches(e))
+	assert.False(t, (&ExportFilter{From: timestamp.Add(time.Second)}).matches(e))
+	assert.True(t, (&ExportFilter{To: timestamp.Add(time.Second)}).matches(e))
+}
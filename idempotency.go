@@ -0,0 +1,245 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrDuplicateCommand is when events are saved with an idempotency key that
+// was already used. The BaseErr of the eh.EventStoreError is a
+// DuplicateCommandError with the result of the first save.
+var ErrDuplicateCommand = errors.New("duplicate command")
+
+// ErrIdempotencyNotEnabled is when events are saved with an idempotency key
+// but idempotency is not enabled in the config.
+var ErrIdempotencyNotEnabled = errors.New("idempotency not enabled")
+
+// DuplicateCommandError contains the result of the save that first used an
+// idempotency key.
+type DuplicateCommandError struct {
+	Key         string
+	AggregateID uuid.UUID
+	Version     int
+	CommittedAt time.Time
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e DuplicateCommandError) Error() string {
+	return fmt.Sprintf("key %s already saved %s@%d", e.Key, e.AggregateID, e.Version)
+}
+
+type idempotencyContextKey int
+
+const idempotencyKey idempotencyContextKey = iota
+
+// NewContextWithIdempotencyKey returns the context with an idempotency key
+// set. Events saved with the context are only saved once per key, retries
+// return ErrDuplicateCommand instead of appending the events again. When saved
+// in a transaction from the context, use IsDuplicateCommand on the error from
+// committing it.
+func NewContextWithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+// IdempotencyKeyFromContext returns the idempotency key from the context, if
+// one is set.
+func IdempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKey).(string)
+	return key, ok && key != ""
+}
+
+// IsDuplicateCommand returns true if the error is from saving events with an
+// idempotency key that was already used. It also detects a used key when
+// committing a transaction from the context, as the key is then only checked
+// by the commit.
+func IsDuplicateCommand(err error) bool {
+	switch err := err.(type) {
+	case eh.EventStoreError:
+		return err.Err == ErrDuplicateCommand
+	case TxError:
+		if err.Err != ErrTxCanceled {
+			return false
+		}
+		for _, r := range err.Reasons {
+			if r.Code == "ConditionalCheckFailed" && strings.HasPrefix(r.Operation, idempotencyOpPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// idempotencyOpPrefix starts the description of the transaction operation
+// that records an idempotency key.
+const idempotencyOpPrefix = "record idempotency key "
+
+// saveIdempotent saves the events together with a record of the idempotency
+// key in one transaction. If the context already has a transaction the writes
+// are added to it, and duplicates are detected when it is committed.
+func (s *EventStore) saveIdempotent(ctx context.Context, key string, events []eh.Event, originalVersion int) error {
+	if !s.config.Idempotency {
+		return eh.EventStoreError{
+			Err:       ErrIdempotencyNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Fail early on known duplicates.
+	if err := s.checkIdempotencyKey(ctx, key); err != nil {
+		return err
+	}
+
+	tx := TxFromContext(ctx)
+	ownTx := tx == nil
+	if ownTx {
+		tx = s.NewTx()
+	}
+
+	// Save the events to the transaction without the key.
+	first := tx.Len()
+	txCtx := NewContextWithTx(NewContextWithIdempotencyKey(ctx, ""), tx)
+	if err := s.Save(txCtx, events, originalVersion); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	table := s.service.Table(s.IdempotencyTableName(ctx))
+	put := table.Put(dbIdempotencyRecord{
+		IdempotencyKey: key,
+		AggregateID:    events[0].AggregateID(),
+		Version:        events[len(events)-1].Version(),
+		CommittedAt:    now,
+		ExpiresAt:      now.Add(s.config.IdempotencyTTL).Unix(),
+	}).If("attribute_not_exists(IdempotencyKey) OR ExpiresAt < ?", now.Unix())
+	keyIndex := tx.Len()
+	tx.put(fmt.Sprintf(idempotencyOpPrefix+"%s in %s", key, table.Name()), put)
+
+	if !ownTx {
+		return nil
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		txErr, ok := err.(TxError)
+		if !ok || txErr.Err != ErrTxCanceled {
+			return eh.EventStoreError{
+				BaseErr:   err,
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+
+		// A concurrent retry of a saved command also conflicts with the saved
+		// events, so a used key is checked first.
+		if IsDuplicateCommand(txErr) {
+			if err := s.checkIdempotencyKey(ctx, key); err != nil {
+				return err
+			}
+		}
+		for _, r := range txErr.Reasons {
+			if r.Code == "ConditionalCheckFailed" && r.Index >= first && r.Index < keyIndex {
+				return eh.EventStoreError{
+					BaseErr:   err,
+					Err:       ErrCouldNotSaveAggregate,
+					Namespace: eh.NamespaceFromContext(ctx),
+				}
+			}
+		}
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// checkIdempotencyKey returns ErrDuplicateCommand if the key has been used.
+func (s *EventStore) checkIdempotencyKey(ctx context.Context, key string) error {
+	table := s.service.Table(s.IdempotencyTableName(ctx))
+
+	var record dbIdempotencyRecord
+	err := table.Get("IdempotencyKey", key).Consistent(true).OneWithContext(ctx, &record)
+	if err == dynamo.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	// Expired records may not have been removed yet.
+	if record.ExpiresAt < time.Now().Unix() {
+		return nil
+	}
+
+	return eh.EventStoreError{
+		BaseErr: DuplicateCommandError{
+			Key:         record.IdempotencyKey,
+			AggregateID: record.AggregateID,
+			Version:     record.Version,
+			CommittedAt: record.CommittedAt,
+		},
+		Err:       ErrDuplicateCommand,
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+}
+
+// createIdempotencyTable creates the idempotency table with a TTL.
+func (s *EventStore) createIdempotencyTable(ctx context.Context) error {
+	if err := s.service.CreateTable(s.IdempotencyTableName(ctx), dbIdempotencyRecord{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(s.IdempotencyTableName(ctx)),
+	}
+	if err := s.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return s.enableTTL(ctx, s.IdempotencyTableName(ctx))
+}
+
+// IdempotencyTableName appends the namespace, if one is set, to the
+// idempotency table prefix to get the name of the table to use.
+func (s *EventStore) IdempotencyTableName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return s.config.IdempotencyTablePrefix + "_" + ns
+}
+
+// dbIdempotencyRecord is the record of a used idempotency key, removed by
+// the TTL of the table after ExpiresAt in Unix seconds.
+type dbIdempotencyRecord struct {
+	IdempotencyKey string `dynamo:",hash"`
+
+	AggregateID uuid.UUID
+	Version     int
+	CommittedAt time.Time
+	ExpiresAt   int64
+}
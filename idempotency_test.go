@@ -0,0 +1,163 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type IdempotencyTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event and idempotency tables
+func (suite *IdempotencyTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix:            "eventhorizonTest_" + uuid.New().String(),
+		IdempotencyTablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:               os.Getenv("DYNAMODB_HOST"),
+		Idempotency:            true,
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the tables
+func (suite *IdempotencyTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *IdempotencyTestSuite) TestSaveDuplicate() {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	ctx := NewContextWithIdempotencyKey(context.Background(), "command1")
+
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	assert.Nil(suite.T(), suite.store.Save(ctx, []eh.Event{event1}, 0))
+
+	// A retry with the same key returns the first result.
+	event2 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+		timestamp, mocks.AggregateType, id, 2)
+	err := suite.store.Save(ctx, []eh.Event{event2}, 1)
+	storeErr, ok := err.(eh.EventStoreError)
+	if !ok || storeErr.Err != ErrDuplicateCommand {
+		suite.T().Fatal("there should be a duplicate command error:", err)
+	}
+	dupErr, ok := storeErr.BaseErr.(DuplicateCommandError)
+	assert.True(suite.T(), ok)
+	assert.Equal(suite.T(), "command1", dupErr.Key)
+	assert.Equal(suite.T(), id, dupErr.AggregateID)
+	assert.Equal(suite.T(), 1, dupErr.Version)
+
+	events, err := suite.store.Load(context.Background(), id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 1)
+
+	// Another key saves the events.
+	ctx = NewContextWithIdempotencyKey(context.Background(), "command2")
+	assert.Nil(suite.T(), suite.store.Save(ctx, []eh.Event{event2}, 1))
+}
+
+func (suite *IdempotencyTestSuite) TestSaveConflict() {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	assert.Nil(suite.T(), suite.store.Save(context.Background(), []eh.Event{event1}, 0))
+
+	// A version conflict does not record the key.
+	ctx := NewContextWithIdempotencyKey(context.Background(), "command1")
+	err := suite.store.Save(ctx, []eh.Event{event1}, 0)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrCouldNotSaveAggregate {
+		suite.T().Error("there should be a could not save aggregate error:", err)
+	}
+	assert.Nil(suite.T(), suite.store.checkIdempotencyKey(ctx, "command1"))
+}
+
+// TestIdempotencyTestSuite starts the test suite
+func TestIdempotencyTestSuite(t *testing.T) {
+	suite.Run(t, new(IdempotencyTestSuite))
+}
+
+func TestSaveIdempotencyNotEnabled(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	ctx := NewContextWithIdempotencyKey(context.Background(), "command1")
+
+	err := store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			time.Now(), mocks.AggregateType, uuid.New(), 1),
+	}, 0)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrIdempotencyNotEnabled {
+		t.Error("there should be an idempotency not enabled error:", err)
+	}
+}
+
+func (suite *IdempotencyTestSuite) TestSaveDuplicateInTx() {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	ctx := NewContextWithIdempotencyKey(context.Background(), "command1")
+
+	// Both transactions are built before the key is used.
+	event1 := eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+		timestamp, mocks.AggregateType, id, 1)
+	tx1 := suite.store.NewTx()
+	assert.Nil(suite.T(), suite.store.Save(NewContextWithTx(ctx, tx1), []eh.Event{event1}, 0))
+	tx2 := suite.store.NewTx()
+	assert.Nil(suite.T(), suite.store.Save(NewContextWithTx(ctx, tx2), []eh.Event{event1}, 0))
+
+	err := tx1.Commit(context.Background())
+	assert.Nil(suite.T(), err)
+	assert.False(suite.T(), IsDuplicateCommand(err))
+
+	err = tx2.Commit(context.Background())
+	assert.True(suite.T(), IsDuplicateCommand(err), "there should be a duplicate command error: %v", err)
+}
+
+func TestIsDuplicateCommand(t *testing.T) {
+	assert.True(t, IsDuplicateCommand(eh.EventStoreError{Err: ErrDuplicateCommand}))
+	assert.False(t, IsDuplicateCommand(eh.EventStoreError{Err: ErrCouldNotSaveAggregate}))
+	assert.False(t, IsDuplicateCommand(nil))
+
+	// The condition of the key record failed in a transaction.
+	assert.True(t, IsDuplicateCommand(TxError{
+		Err: ErrTxCanceled,
+		Reasons: []TxCancellationReason{
+			{Index: 0, Operation: "save event event1 of id in table", Code: "ConditionalCheckFailed"},
+			{Index: 1, Operation: idempotencyOpPrefix + "command1 in table", Code: "ConditionalCheckFailed"},
+		},
+	}))
+
+	// Only the saved events conflicted.
+	assert.False(t, IsDuplicateCommand(TxError{
+		Err: ErrTxCanceled,
+		Reasons: []TxCancellationReason{
+			{Index: 0, Operation: "save event event1 of id in table", Code: "ConditionalCheckFailed"},
+			{Index: 1, Operation: idempotencyOpPrefix + "command1 in table", Code: "None"},
+		},
+	}))
+}
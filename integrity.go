@@ -0,0 +1,389 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrIntegrityNotEnabled is when the hash chains are verified but integrity
+// is not enabled in the config.
+var ErrIntegrityNotEnabled = errors.New("integrity not enabled")
+
+// IntegrityBreak is the first broken link in the hash chain of an aggregate.
+type IntegrityBreak struct {
+	AggregateID uuid.UUID `json:"aggregate_id"`
+	Version     int       `json:"version"`
+	Reason      string    `json:"reason"`
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (b IntegrityBreak) Error() string {
+	return fmt.Sprintf("broken hash chain at %s@%d: %s", b.AggregateID, b.Version, b.Reason)
+}
+
+// VerifyChain walks the hash chain of an aggregate and returns the first
+// broken link, or nil if the chain is intact. Events older than
+// IntegritySince of the config can have no hash, the chain starts at the
+// first event with a hash. Events removed by retention are not reported as
+// missing if they are older than all remaining events.
+func (s *EventStore) VerifyChain(ctx context.Context, id uuid.UUID) (*IntegrityBreak, error) {
+	if !s.config.Integrity {
+		return nil, eh.EventStoreError{
+			Err:       ErrIntegrityNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	table := s.service.Table(s.TableName(ctx))
+
+	var dbEvents []dbEvent
+	err := table.Get("AggregateID", id.String()).Consistent(true).AllWithContext(ctx, &dbEvents)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	links := make([]chainLink, len(dbEvents))
+	for i, e := range dbEvents {
+		links[i] = newChainLink(s.config.IntegrityKey, &e)
+	}
+	return verifyChain(id, links, s.config.IntegritySince, s.config.Retention), nil
+}
+
+// VerifyChains walks the hash chains of all aggregates and returns the first
+// broken link of every aggregate with a broken chain, sorted by aggregate ID.
+// The hashes of every aggregate are kept in memory until the scan is done.
+func (s *EventStore) VerifyChains(ctx context.Context) ([]IntegrityBreak, error) {
+	if !s.config.Integrity {
+		return nil, eh.EventStoreError{
+			Err:       ErrIntegrityNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	aggregates := map[uuid.UUID][]chainLink{}
+	var mu sync.Mutex
+	scan := &segmentScan{
+		segments: 4,
+		pageSize: 100,
+	}
+	err := s.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		links := make([]chainLink, len(page))
+		for i, e := range page {
+			links[i] = newChainLink(s.config.IntegrityKey, &e)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for i, e := range page {
+			aggregates[e.AggregateID] = append(aggregates[e.AggregateID], links[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	breaks := []IntegrityBreak{}
+	for id, links := range aggregates {
+		if b := verifyChain(id, links, s.config.IntegritySince, s.config.Retention); b != nil {
+			breaks = append(breaks, *b)
+		}
+	}
+	sort.Slice(breaks, func(i, j int) bool {
+		return bytes.Compare(breaks[i].AggregateID[:], breaks[j].AggregateID[:]) < 0
+	})
+
+	return breaks, nil
+}
+
+// chainLink is the part of an event needed to verify its hash chain.
+type chainLink struct {
+	version       int
+	aggregateType eh.AggregateType
+	timestamp     time.Time
+	hash          string
+	prevHash      string
+	// computed is the hash of the stored event content.
+	computed string
+}
+
+func newChainLink(key []byte, e *dbEvent) chainLink {
+	return chainLink{
+		version:       e.Version,
+		aggregateType: e.AggregateType,
+		timestamp:     e.Timestamp,
+		hash:          e.Hash,
+		prevHash:      e.PrevHash,
+		computed:      eventHash(key, e),
+	}
+}
+
+// verifyChain returns the first broken link of the hash chain of an
+// aggregate, or nil if it is intact. Events without a hash are only allowed
+// before the chain starts and before since. The first events are only
+// allowed to be missing if the aggregate type has a retention.
+func verifyChain(id uuid.UUID, links []chainLink, since time.Time, retention map[eh.AggregateType]time.Duration) *IntegrityBreak {
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].version < links[j].version
+	})
+
+	broken := func(version int, reason string) *IntegrityBreak {
+		return &IntegrityBreak{AggregateID: id, Version: version, Reason: reason}
+	}
+	started := false
+	for i, l := range links {
+		if i == 0 && l.version > 1 {
+			if _, ok := retention[l.aggregateType]; !ok {
+				return broken(1, "event is missing")
+			}
+		} else if i > 0 && l.version != links[i-1].version+1 {
+			return broken(links[i-1].version+1, "event is missing")
+		}
+
+		if l.hash == "" {
+			if started || !l.timestamp.Before(since) {
+				return broken(l.version, "event has no hash")
+			}
+			continue
+		}
+		started = true
+
+		// The previous hash of the first remaining event is unknown if the
+		// events before it have expired.
+		if i > 0 {
+			if l.prevHash != links[i-1].hash {
+				return broken(l.version, "previous hash does not match the previous event")
+			}
+		} else if l.version == 1 && l.prevHash != "" {
+			return broken(l.version, "previous hash does not match the previous event")
+		}
+		if l.hash != l.computed {
+			return broken(l.version, "hash does not match the event")
+		}
+	}
+
+	return nil
+}
+
+// chainHash returns the hash of the event before the saved events, which is
+// empty for the first event of an aggregate or if the previous event has no
+// hash. The events of earlier saves in the same uncommitted transaction are
+// not found, so an aggregate must only be saved once per transaction.
+func (s *EventStore) chainHash(ctx context.Context, id uuid.UUID, originalVersion int) (string, error) {
+	if originalVersion == 0 {
+		return "", nil
+	}
+
+	table := s.service.Table(s.TableName(ctx))
+
+	var previous dbEvent
+	err := table.Get("AggregateID", id.String()).
+		Range("Version", dynamo.Equal, originalVersion).
+		Consistent(true).OneWithContext(ctx, &previous)
+	if err == dynamo.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return previous.Hash, nil
+}
+
+// rehashChain links the events of an aggregate after a version to the hash
+// of that version, and updates their hashes. Every update is conditional on
+// the hash it replaces, events saved during the rehash are not rehashed.
+func (s *EventStore) rehashChain(ctx context.Context, id uuid.UUID, version int, prevHash string) error {
+	table := s.service.Table(s.TableName(ctx))
+
+	var dbEvents []dbEvent
+	err := table.Get("AggregateID", id.String()).
+		Range("Version", dynamo.Greater, version).
+		Consistent(true).AllWithContext(ctx, &dbEvents)
+	if err != nil && err != dynamo.ErrNotFound {
+		return err
+	}
+
+	for _, e := range dbEvents {
+		update := table.Update("AggregateID", e.AggregateID).Range("Version", e.Version)
+		if e.Hash == "" {
+			update.If("attribute_not_exists(Hash)")
+		} else {
+			update.If("Hash = ?", e.Hash)
+		}
+
+		e.PrevHash = prevHash
+		e.Hash = eventHash(s.config.IntegrityKey, &e)
+		if e.PrevHash == "" {
+			update.Remove("PrevHash")
+		} else {
+			update.Set("PrevHash", e.PrevHash)
+		}
+		if err := update.Set("Hash", e.Hash).RunWithContext(ctx); err != nil {
+			return err
+		}
+		prevHash = e.Hash
+	}
+
+	return nil
+}
+
+// importChain links an imported event to the previous event of its
+// aggregate, from the events imported so far in heads or else from the
+// table, and hashes it.
+func (s *EventStore) importChain(ctx context.Context, e *dbEvent, heads map[uuid.UUID]chainLink) error {
+	if head, ok := heads[e.AggregateID]; ok && head.version == e.Version-1 {
+		e.PrevHash = head.hash
+	} else {
+		var err error
+		if e.PrevHash, err = s.chainHash(ctx, e.AggregateID, e.Version-1); err != nil {
+			return err
+		}
+	}
+	e.Hash = eventHash(s.config.IntegrityKey, e)
+	heads[e.AggregateID] = chainLink{version: e.Version, hash: e.Hash}
+	return nil
+}
+
+// eventHash returns the hex encoded SHA-256 hash of the previous hash and
+// the content of an event, which is the aggregate ID, version, event type,
+// aggregate type, timestamp and data. With a key it is an HMAC-SHA256. The
+// data is encoded canonically, as DynamoDB does not keep the order of sets
+// or the format of numbers.
+func eventHash(key []byte, e *dbEvent) string {
+	h := sha256.New()
+	if len(key) > 0 {
+		h = hmac.New(sha256.New, key)
+	}
+	writeHashString(h, e.PrevHash)
+	writeHashString(h, e.AggregateID.String())
+	writeHashString(h, fmt.Sprint(e.Version))
+	writeHashString(h, string(e.EventType))
+	writeHashString(h, string(e.AggregateType))
+	writeHashString(h, e.Timestamp.UTC().Format(time.RFC3339Nano))
+	writeHashAttribute(h, &dynamodb.AttributeValue{M: e.RawData})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeHashString writes a length prefixed string to the hash.
+func writeHashString(h hash.Hash, s string) {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+	h.Write(n[:])
+	h.Write([]byte(s))
+}
+
+// writeHashAttribute writes an attribute value to the hash, with map keys
+// and sets sorted and numbers normalized.
+func writeHashAttribute(h hash.Hash, av *dynamodb.AttributeValue) {
+	switch {
+	case av == nil || av.NULL != nil:
+		writeHashString(h, "NULL")
+	case av.S != nil:
+		writeHashString(h, "S")
+		writeHashString(h, *av.S)
+	case av.N != nil:
+		writeHashString(h, "N")
+		writeHashString(h, normalizeNumber(*av.N))
+	case av.B != nil:
+		writeHashString(h, "B")
+		writeHashString(h, string(av.B))
+	case av.BOOL != nil:
+		writeHashString(h, "BOOL")
+		writeHashString(h, fmt.Sprint(*av.BOOL))
+	case av.SS != nil:
+		writeHashSet(h, "SS", av.SS, func(s string) string { return s })
+	case av.NS != nil:
+		writeHashSet(h, "NS", av.NS, normalizeNumber)
+	case av.BS != nil:
+		set := make([]*string, len(av.BS))
+		for i, b := range av.BS {
+			s := string(b)
+			set[i] = &s
+		}
+		writeHashSet(h, "BS", set, func(s string) string { return s })
+	case av.L != nil:
+		writeHashString(h, "L")
+		writeHashString(h, fmt.Sprint(len(av.L)))
+		for _, v := range av.L {
+			writeHashAttribute(h, v)
+		}
+	default:
+		// Maps, including a nil map for events without data.
+		keys := make([]string, 0, len(av.M))
+		for k := range av.M {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeHashString(h, "M")
+		writeHashString(h, fmt.Sprint(len(keys)))
+		for _, k := range keys {
+			writeHashString(h, k)
+			writeHashAttribute(h, av.M[k])
+		}
+	}
+}
+
+func writeHashSet(h hash.Hash, kind string, set []*string, normalize func(string) string) {
+	values := make([]string, len(set))
+	for i, v := range set {
+		values[i] = normalize(*v)
+	}
+	sort.Strings(values)
+	writeHashString(h, kind)
+	writeHashString(h, fmt.Sprint(len(values)))
+	for _, v := range values {
+		writeHashString(h, v)
+	}
+}
+
+// normalizeNumber returns the shortest form of a number, as returned by
+// DynamoDB which drops leading and trailing zeros.
+func normalizeNumber(n string) string {
+	f, _, err := big.ParseFloat(n, 10, 256, big.ToNearestEven)
+	if err != nil {
+		return n
+	}
+	return f.Text('g', -1)
+}
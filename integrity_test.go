@@ -0,0 +1,260 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type IntegrityTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event table
+func (suite *IntegrityTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix:  "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:     os.Getenv("DYNAMODB_HOST"),
+		Integrity:    true,
+		IntegrityKey: []byte("key"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the table
+func (suite *IntegrityTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *IntegrityTestSuite) TestChain() {
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, id, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp, mocks.AggregateType, id, 3),
+	}, 2)
+	assert.Nil(suite.T(), err)
+
+	b, err := suite.store.VerifyChain(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), b)
+
+	// Replacing an event relinks the chain.
+	err = suite.store.Replace(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "changed"},
+		timestamp, mocks.AggregateType, id, 2))
+	assert.Nil(suite.T(), err)
+
+	b, err = suite.store.VerifyChain(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), b)
+
+	// Changing an event without rehashing breaks the chain.
+	table := suite.store.service.Table(suite.store.TableName(ctx))
+	err = table.Update("AggregateID", id.String()).Range("Version", 2).
+		Set("EventType", mocks.EventOtherType).Run()
+	assert.Nil(suite.T(), err)
+
+	b, err = suite.store.VerifyChain(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &IntegrityBreak{AggregateID: id, Version: 2, Reason: "hash does not match the event"}, b)
+
+	breaks, err := suite.store.VerifyChains(ctx)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), []IntegrityBreak{*b}, breaks)
+}
+
+func (suite *IntegrityTestSuite) TestChainImport() {
+	ctx := context.Background()
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// The imported events are linked to the stored event and to each other.
+	var buf bytes.Buffer
+	assert.Nil(suite.T(), ExportEvents(&buf, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, id, 2),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp, mocks.AggregateType, id, 3),
+	}))
+	result, err := suite.store.Import(ctx, &buf)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), result.Imported)
+
+	b, err := suite.store.VerifyChain(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), b)
+}
+
+func (suite *IntegrityTestSuite) TestChainTampering() {
+	ctx := context.Background()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	// Overwriting the only event of an aggregate without a hash is visible.
+	replaced := uuid.New()
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, replaced, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	e, err := newDBEvent(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "changed"},
+		timestamp, mocks.AggregateType, replaced, 1))
+	assert.Nil(suite.T(), err)
+	table := suite.store.service.Table(suite.store.TableName(ctx))
+	assert.Nil(suite.T(), table.Put(e).Run())
+	b, err := suite.store.VerifyChain(ctx, replaced)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &IntegrityBreak{AggregateID: replaced, Version: 1, Reason: "event has no hash"}, b)
+
+	// Deleting the first event is visible.
+	deleted := uuid.New()
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, deleted, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, deleted, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), table.Delete("AggregateID", deleted.String()).Range("Version", 1).Run())
+	b, err = suite.store.VerifyChain(ctx, deleted)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &IntegrityBreak{AggregateID: deleted, Version: 1, Reason: "event is missing"}, b)
+}
+
+// TestIntegrityTestSuite starts the test suite
+func TestIntegrityTestSuite(t *testing.T) {
+	suite.Run(t, new(IntegrityTestSuite))
+}
+
+func TestEventHash(t *testing.T) {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	e := &dbEvent{
+		AggregateID:   id,
+		Version:       1,
+		EventType:     mocks.EventType,
+		AggregateType: mocks.AggregateType,
+		Timestamp:     timestamp,
+		RawData: map[string]*dynamodb.AttributeValue{
+			"Tags":  {SS: []*string{aws.String("a"), aws.String("b")}},
+			"Price": {N: aws.String("1.50")},
+		},
+	}
+	hash := eventHash(nil, e)
+
+	// Sets in another order, normalized numbers and other time zones hash
+	// the same, as they can be returned so by DynamoDB.
+	same := *e
+	same.Timestamp = timestamp.In(time.FixedZone("CET", 3600))
+	same.RawData = map[string]*dynamodb.AttributeValue{
+		"Price": {N: aws.String("1.5")},
+		"Tags":  {SS: []*string{aws.String("b"), aws.String("a")}},
+	}
+	assert.Equal(t, hash, eventHash(nil, &same))
+
+	changed := *e
+	changed.EventType = mocks.EventOtherType
+	assert.NotEqual(t, hash, eventHash(nil, &changed))
+
+	changed = *e
+	changed.PrevHash = hash
+	assert.NotEqual(t, hash, eventHash(nil, &changed))
+
+	// With a key the hash depends on it.
+	keyed := eventHash([]byte("key"), e)
+	assert.NotEqual(t, hash, keyed)
+	assert.Equal(t, keyed, eventHash([]byte("key"), &same))
+	assert.NotEqual(t, keyed, eventHash([]byte("other"), e))
+}
+
+func TestVerifyChain(t *testing.T) {
+	id := uuid.New()
+	since := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	link := func(version int, prevHash string) chainLink {
+		h := eventHash(nil, &dbEvent{AggregateID: id, Version: version, PrevHash: prevHash})
+		return chainLink{version: version, aggregateType: mocks.AggregateType, timestamp: since,
+			hash: h, prevHash: prevHash, computed: h}
+	}
+	old := func(version int) chainLink {
+		return chainLink{version: version, aggregateType: mocks.AggregateType, timestamp: since.Add(-time.Hour)}
+	}
+	l1 := link(1, "")
+	l2 := link(2, l1.hash)
+	l3 := link(3, l2.hash)
+
+	assert.Nil(t, verifyChain(id, []chainLink{l3, l1, l2}, since, nil))
+
+	// The chain starts at the first event with a hash, events without one
+	// are only allowed before integrity was enabled.
+	assert.Nil(t, verifyChain(id, []chainLink{old(1), link(2, ""), link(3, link(2, "").hash)}, since, nil))
+	b := verifyChain(id, []chainLink{old(1), link(2, "")}, time.Time{}, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 1, Reason: "event has no hash"}, b)
+	replaced := old(1)
+	replaced.timestamp = since
+	b = verifyChain(id, []chainLink{replaced}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 1, Reason: "event has no hash"}, b)
+
+	// Missing first events are only allowed with a retention.
+	b = verifyChain(id, []chainLink{l2, l3}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 1, Reason: "event is missing"}, b)
+	retention := map[eh.AggregateType]time.Duration{mocks.AggregateType: time.Hour}
+	assert.Nil(t, verifyChain(id, []chainLink{l2, l3}, since, retention))
+
+	b = verifyChain(id, []chainLink{l1, l3}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 2, Reason: "event is missing"}, b)
+	b = verifyChain(id, []chainLink{old(1), old(3)}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 2, Reason: "event is missing"}, b)
+
+	changed := l2
+	changed.computed = "other"
+	b = verifyChain(id, []chainLink{l1, changed, l3}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 2, Reason: "hash does not match the event"}, b)
+
+	b = verifyChain(id, []chainLink{l1, link(2, "other"), l3}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 2, Reason: "previous hash does not match the previous event"}, b)
+	b = verifyChain(id, []chainLink{link(1, "other")}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 1, Reason: "previous hash does not match the previous event"}, b)
+
+	b = verifyChain(id, []chainLink{l1, old(2), l3}, since, nil)
+	assert.Equal(t, &IntegrityBreak{AggregateID: id, Version: 2, Reason: "event has no hash"}, b)
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+// JobProgressStore stores how far each scan segment of a job has come, so
+// that an interrupted job can be resumed by running it again with the same
+// job ID.
+type JobProgressStore interface {
+	// LoadProgress returns the cursor of a segment of the job to resume from
+	// and if the segment is done. An empty cursor is the start of the segment.
+	LoadProgress(ctx context.Context, job string, segment int) (cursor string, done bool, err error)
+	// SaveProgress saves the cursor of a segment of the job.
+	SaveProgress(ctx context.Context, job string, segment int, cursor string, done bool) error
+}
+
+// MemoryJobProgressStore is a JobProgressStore that keeps the progress in
+// memory, useful for tests and jobs that are never resumed by a new process.
+type MemoryJobProgressStore struct {
+	progress map[string]jobSegmentProgress
+	mu       sync.RWMutex
+}
+
+type jobSegmentProgress struct {
+	cursor string
+	done   bool
+}
+
+// NewMemoryJobProgressStore creates a new MemoryJobProgressStore.
+func NewMemoryJobProgressStore() *MemoryJobProgressStore {
+	return &MemoryJobProgressStore{
+		progress: map[string]jobSegmentProgress{},
+	}
+}
+
+// LoadProgress implements the LoadProgress method of the JobProgressStore
+// interface.
+func (m *MemoryJobProgressStore) LoadProgress(ctx context.Context, job string, segment int) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p := m.progress[job+"/"+segmentSubject(segment)]
+	return p.cursor, p.done, nil
+}
+
+// SaveProgress implements the SaveProgress method of the JobProgressStore
+// interface.
+func (m *MemoryJobProgressStore) SaveProgress(ctx context.Context, job string, segment int, cursor string, done bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.progress[job+"/"+segmentSubject(segment)] = jobSegmentProgress{cursor: cursor, done: done}
+	return nil
+}
+
+// segmentSubject is the subject of the progress of a segment of a job.
+func segmentSubject(segment int) string {
+	return fmt.Sprintf("$segment/%d", segment)
+}
+
+// segmentScan is a parallel scan of the event table in segments, with the
+// progress of every segment saved after each page.
+type segmentScan struct {
+	job      string
+	segments int
+	pageSize int64
+	progress JobProgressStore
+	// clearWhenDone clears the progress once all segments are done, so that
+	// running the job again scans the table again instead of doing nothing.
+	clearWhenDone bool
+
+	// filter is an optional filter expression, with names and values
+	// referenced as #name and :value.
+	filter string
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+// runSegmentScan scans all segments in parallel and calls handle for every page with
+// the matching events and the number of scanned items. The progress of a
+// segment is only saved once handle returns without error, so pages can be
+// handled twice when a job is resumed. The first error stops all segments
+// and is returned, unless the parent context was canceled.
+func (s *EventStore) runSegmentScan(parent context.Context, scan *segmentScan, handle func(ctx context.Context, page []dbEvent, scanned int64) error) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// The other segments fail with cancellations after the first error.
+	var firstErr error
+	var errMu sync.Mutex
+	var wg sync.WaitGroup
+	for segment := 0; segment < scan.segments; segment++ {
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			if err := s.scanSegment(ctx, scan, segment, handle); err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				cancel()
+			}
+		}(segment)
+	}
+	wg.Wait()
+
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if scan.progress != nil && scan.clearWhenDone {
+		for segment := 0; segment < scan.segments; segment++ {
+			if err := scan.progress.SaveProgress(parent, scan.job, segment, "", false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *EventStore) scanSegment(ctx context.Context, scan *segmentScan, segment int, handle func(ctx context.Context, page []dbEvent, scanned int64) error) error {
+	var cursor string
+	if scan.progress != nil {
+		var done bool
+		var err error
+		if cursor, done, err = scan.progress.LoadProgress(ctx, scan.job, segment); err != nil {
+			return err
+		} else if done {
+			return nil
+		}
+	}
+
+	for {
+		startKey, err := decodeCursor(cursor)
+		if err != nil {
+			return err
+		}
+
+		input := &dynamodb.ScanInput{
+			TableName:         aws.String(s.TableName(ctx)),
+			Segment:           aws.Int64(int64(segment)),
+			TotalSegments:     aws.Int64(int64(scan.segments)),
+			Limit:             aws.Int64(scan.pageSize),
+			ExclusiveStartKey: startKey,
+			ConsistentRead:    aws.Bool(true),
+		}
+		if scan.filter != "" {
+			input.FilterExpression = aws.String(scan.filter)
+			input.ExpressionAttributeNames = scan.names
+			input.ExpressionAttributeValues = scan.values
+		}
+		output, err := s.service.Client().ScanWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		page := make([]dbEvent, len(output.Items))
+		for i, item := range output.Items {
+			if err := dynamo.UnmarshalItem(item, &page[i]); err != nil {
+				return err
+			}
+		}
+		if err := handle(ctx, page, aws.Int64Value(output.ScannedCount)); err != nil {
+			return err
+		}
+
+		if cursor, err = encodeCursor(dynamo.PagingKey(output.LastEvaluatedKey)); err != nil {
+			return err
+		}
+		done := cursor == ""
+		if scan.progress != nil {
+			if err := scan.progress.SaveProgress(ctx, scan.job, segment, cursor, done); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+)
+
+// ErrLeaseHeld is when a lease is held by another owner.
+var ErrLeaseHeld = errors.New("lease held by another owner")
+
+// ErrLeaseLost is when a lease has expired and was taken by another owner,
+// or was released.
+var ErrLeaseLost = errors.New("lease lost")
+
+// ErrCouldNotAcquireLease is when a lease could not be acquired.
+var ErrCouldNotAcquireLease = errors.New("could not acquire lease")
+
+// LeaseError is an error in the lease manager.
+type LeaseError struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Name is the name of the lease.
+	Name string
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e LeaseError) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	return errStr + " (" + e.Name + ")"
+}
+
+// LeaseManagerConfig is a config for the DynamoDB lease manager.
+type LeaseManagerConfig struct {
+	TableName string
+	Region    string
+	Endpoint  string
+
+	// Owner identifies this instance, defaults to a random UUID.
+	Owner string
+	// LeaseDuration is how long a lease is valid without being renewed,
+	// defaults to 10 seconds.
+	LeaseDuration time.Duration
+	// RenewInterval is how often held leases are renewed, defaults to a
+	// third of the lease duration.
+	RenewInterval time.Duration
+}
+
+func (c *LeaseManagerConfig) provideDefaults() {
+	if c.TableName == "" {
+		c.TableName = "eventhorizonLeases"
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Owner == "" {
+		c.Owner = uuid.New().String()
+	}
+	if c.LeaseDuration == 0 {
+		c.LeaseDuration = 10 * time.Second
+	}
+	if c.RenewInterval == 0 {
+		c.RenewInterval = c.LeaseDuration / 3
+	}
+}
+
+// Lease is a named lease held by an owner until it expires. The token is
+// increased every time the lease is acquired and can be used as a fencing
+// token, to reject writes from previous holders of the lease.
+type Lease struct {
+	Name    string
+	Owner   string
+	Token   int64
+	Expires time.Time
+}
+
+// LeaseManager acquires, renews and releases named leases, for example for
+// leader election between instances of a projector. Expiry is based on the
+// local clocks of the instances, which must be reasonably in sync compared
+// to the lease duration.
+type LeaseManager struct {
+	service *dynamo.DB
+	config  *LeaseManagerConfig
+	now     func() time.Time
+}
+
+// NewLeaseManager creates a new LeaseManager.
+func NewLeaseManager(config *LeaseManagerConfig) (*LeaseManager, error) {
+	config.provideDefaults()
+
+	awsConfig := &aws.Config{
+		Region:   aws.String(config.Region),
+		Endpoint: aws.String(config.Endpoint),
+	}
+
+	session, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	db := dynamo.New(session)
+	return NewLeaseManagerWithDB(config, db), nil
+}
+
+// NewLeaseManagerWithDB creates a new LeaseManager with DB
+func NewLeaseManagerWithDB(config *LeaseManagerConfig, db *dynamo.DB) *LeaseManager {
+	config.provideDefaults()
+
+	return &LeaseManager{
+		service: db,
+		config:  config,
+		now:     time.Now,
+	}
+}
+
+// Owner returns the owner ID of the lease manager.
+func (m *LeaseManager) Owner() string {
+	return m.config.Owner
+}
+
+// Acquire acquires the named lease if it is free, expired or already held by
+// this owner. Otherwise ErrLeaseHeld is returned.
+func (m *LeaseManager) Acquire(ctx context.Context, name string) (*Lease, error) {
+	table := m.service.Table(m.config.TableName)
+	now := m.now()
+
+	var record dbLease
+	err := table.Update("Name", name).
+		Set("Owner", m.config.Owner).
+		Set("Expires", now.Add(m.config.LeaseDuration).UnixNano()).
+		Add("Token", 1).
+		If("attribute_not_exists('Name') OR 'Expires' < ? OR 'Owner' = ?", now.UnixNano(), m.config.Owner).
+		ValueWithContext(ctx, &record)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, LeaseError{
+				Err:     ErrLeaseHeld,
+				BaseErr: err,
+				Name:    name,
+			}
+		}
+		return nil, LeaseError{
+			Err:     ErrCouldNotAcquireLease,
+			BaseErr: err,
+			Name:    name,
+		}
+	}
+
+	return record.lease(), nil
+}
+
+// Renew extends the lease by the lease duration. ErrLeaseLost is returned if
+// the lease is no longer held by this owner with the same token.
+func (m *LeaseManager) Renew(ctx context.Context, lease *Lease) (*Lease, error) {
+	table := m.service.Table(m.config.TableName)
+	now := m.now()
+
+	var record dbLease
+	err := table.Update("Name", lease.Name).
+		Set("Expires", now.Add(m.config.LeaseDuration).UnixNano()).
+		If("'Owner' = ? AND 'Token' = ? AND 'Expires' >= ?", lease.Owner, lease.Token, now.UnixNano()).
+		ValueWithContext(ctx, &record)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, LeaseError{
+				Err:     ErrLeaseLost,
+				BaseErr: err,
+				Name:    lease.Name,
+			}
+		}
+		return nil, LeaseError{
+			Err:     ErrCouldNotAcquireLease,
+			BaseErr: err,
+			Name:    lease.Name,
+		}
+	}
+
+	return record.lease(), nil
+}
+
+// Release releases the lease so that another owner can acquire it without
+// waiting for it to expire. The token is kept, so that the next holder gets a
+// higher token. ErrLeaseLost is returned if the lease was no longer held.
+func (m *LeaseManager) Release(ctx context.Context, lease *Lease) error {
+	table := m.service.Table(m.config.TableName)
+
+	err := table.Update("Name", lease.Name).
+		Set("Expires", 0).
+		Remove("Owner").
+		If("'Owner' = ? AND 'Token' = ?", lease.Owner, lease.Token).
+		RunWithContext(ctx)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return LeaseError{
+				Err:     ErrLeaseLost,
+				BaseErr: err,
+				Name:    lease.Name,
+			}
+		}
+		return LeaseError{
+			Err:     ErrCouldNotAcquireLease,
+			BaseErr: err,
+			Name:    lease.Name,
+		}
+	}
+
+	return nil
+}
+
+// Hold acquires the named lease and keeps renewing it in the background until
+// the context is canceled, when the lease is released. If the lease is lost,
+// because it could not be renewed before it expired, onLost is called with
+// the cause and renewing stops.
+func (m *LeaseManager) Hold(ctx context.Context, name string, onLost func(*Lease, error)) (*Lease, error) {
+	lease, err := m.Acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.config.RenewInterval)
+		defer ticker.Stop()
+
+		current := lease
+		for {
+			select {
+			case <-ctx.Done():
+				// Use a fresh context, as the held one is already canceled.
+				releaseCtx, cancel := context.WithTimeout(context.Background(), m.config.LeaseDuration)
+				_ = m.Release(releaseCtx, current)
+				cancel()
+				return
+			case <-ticker.C:
+			}
+
+			renewed, err := m.Renew(ctx, current)
+			if err == nil {
+				current = renewed
+				continue
+			}
+			if ctx.Err() != nil {
+				continue
+			}
+
+			// Keep trying on temporary errors while the lease is still valid.
+			if leaseErr, ok := err.(LeaseError); (ok && leaseErr.Err == ErrLeaseLost) ||
+				!m.now().Before(current.Expires) {
+				if onLost != nil {
+					onLost(current, err)
+				}
+				return
+			}
+		}
+	}()
+
+	return lease, nil
+}
+
+// CreateTable creates the table if it is not already existing and correct.
+func (m *LeaseManager) CreateTable(ctx context.Context) error {
+	if err := m.service.CreateTable(m.config.TableName, dbLease{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.config.TableName),
+	}
+	if err := m.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteTable deletes the lease table.
+func (m *LeaseManager) DeleteTable(ctx context.Context) error {
+	table := m.service.Table(m.config.TableName)
+	err := table.DeleteTable().Run()
+	if err != nil {
+		if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ResourceNotFoundException" {
+			return nil
+		}
+		return ErrCouldNotClearDB
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.config.TableName),
+	}
+	if err := m.service.Client().WaitUntilTableNotExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dbLease is the record of a lease, with the expiry in Unix nanoseconds.
+type dbLease struct {
+	Name    string `dynamo:",hash"`
+	Owner   string
+	Token   int64
+	Expires int64
+}
+
+func (r dbLease) lease() *Lease {
+	return &Lease{
+		Name:    r.Name,
+		Owner:   r.Owner,
+		Token:   r.Token,
+		Expires: time.Unix(0, r.Expires),
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LeaseManagerTestSuite struct {
+	suite.Suite
+	m1, m2 *LeaseManager
+}
+
+// SetupTest will create two lease managers sharing a table
+func (suite *LeaseManagerTestSuite) SetupTest() {
+	tableName := "eventhorizonTest_" + uuid.New().String()
+
+	var err error
+	suite.m1, err = NewLeaseManager(&LeaseManagerConfig{
+		TableName:     tableName,
+		Endpoint:      os.Getenv("DYNAMODB_HOST"),
+		LeaseDuration: time.Second,
+		RenewInterval: 100 * time.Millisecond,
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	suite.m2, err = NewLeaseManager(&LeaseManagerConfig{
+		TableName:     tableName,
+		Endpoint:      os.Getenv("DYNAMODB_HOST"),
+		LeaseDuration: time.Second,
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+
+	assert.Nil(suite.T(), suite.m1.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the table
+func (suite *LeaseManagerTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.m1.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *LeaseManagerTestSuite) TestAcquireRenewRelease() {
+	ctx := context.Background()
+
+	lease, err := suite.m1.Acquire(ctx, "leader")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), suite.m1.Owner(), lease.Owner)
+	assert.Equal(suite.T(), int64(1), lease.Token)
+
+	_, err = suite.m2.Acquire(ctx, "leader")
+	if leaseErr, ok := err.(LeaseError); !ok || leaseErr.Err != ErrLeaseHeld {
+		suite.T().Error("there should be a lease held error:", err)
+	}
+
+	renewed, err := suite.m1.Renew(ctx, lease)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), lease.Token, renewed.Token)
+	assert.True(suite.T(), !renewed.Expires.Before(lease.Expires))
+
+	assert.Nil(suite.T(), suite.m1.Release(ctx, renewed))
+	_, err = suite.m1.Renew(ctx, renewed)
+	if leaseErr, ok := err.(LeaseError); !ok || leaseErr.Err != ErrLeaseLost {
+		suite.T().Error("there should be a lease lost error:", err)
+	}
+
+	// The fencing token increases with every acquisition.
+	lease2, err := suite.m2.Acquire(ctx, "leader")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(2), lease2.Token)
+}
+
+func (suite *LeaseManagerTestSuite) TestAcquireExpired() {
+	ctx := context.Background()
+
+	lease, err := suite.m1.Acquire(ctx, "leader")
+	assert.Nil(suite.T(), err)
+
+	suite.m2.now = func() time.Time { return time.Now().Add(2 * time.Second) }
+	lease2, err := suite.m2.Acquire(ctx, "leader")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), lease.Token+1, lease2.Token)
+
+	_, err = suite.m1.Renew(ctx, lease)
+	if leaseErr, ok := err.(LeaseError); !ok || leaseErr.Err != ErrLeaseLost {
+		suite.T().Error("there should be a lease lost error:", err)
+	}
+}
+
+func (suite *LeaseManagerTestSuite) TestHold() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lost := make(chan *Lease, 1)
+	lease, err := suite.m1.Hold(ctx, "leader", func(l *Lease, err error) {
+		lost <- l
+	})
+	assert.Nil(suite.T(), err)
+
+	// The lease is renewed past its original duration.
+	time.Sleep(1500 * time.Millisecond)
+	_, err = suite.m2.Acquire(context.Background(), "leader")
+	if leaseErr, ok := err.(LeaseError); !ok || leaseErr.Err != ErrLeaseHeld {
+		suite.T().Error("there should be a lease held error:", err)
+	}
+
+	// Steal the lease to trigger the callback.
+	suite.m2.now = func() time.Time { return time.Now().Add(time.Hour) }
+	_, err = suite.m2.Acquire(context.Background(), "leader")
+	assert.Nil(suite.T(), err)
+
+	select {
+	case l := <-lost:
+		assert.Equal(suite.T(), lease.Name, l.Name)
+	case <-time.After(5 * time.Second):
+		suite.T().Error("the lease should be lost")
+	}
+}
+
+// TestLeaseManagerTestSuite starts the test suite
+func TestLeaseManagerTestSuite(t *testing.T) {
+	suite.Run(t, new(LeaseManagerTestSuite))
+}
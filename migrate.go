@@ -0,0 +1,671 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrMigrationInProgress is when a migration is started while it is already
+// running, or after a previous run was interrupted. Use Migrator.Unlock to
+// resume an interrupted migration.
+var ErrMigrationInProgress = errors.New("migration in progress")
+
+// ErrMigrationChangedKey is when an in place migration transforms an event
+// to another aggregate ID or version.
+var ErrMigrationChangedKey = errors.New("migration changed event key")
+
+// ErrInvalidMigration is when a migration has no ID or transform.
+var ErrInvalidMigration = errors.New("invalid migration")
+
+// ErrMigrationGap is when an in place migration drops an event that is
+// followed by events that are kept, which would leave a gap in the versions
+// of the aggregate.
+var ErrMigrationGap = errors.New("migration leaves version gap")
+
+// ErrMigrationConflict is when a copying migration writes an event to a key
+// in the target table that already has another event.
+var ErrMigrationConflict = errors.New("migration conflicts with copied event")
+
+const (
+	migrationRunning = "running"
+	migrationApplied = "applied"
+)
+
+// Migration transforms the stored events.
+type Migration struct {
+	// ID identifies the migration, which is applied only once per namespace.
+	ID string
+	// EventTypes and AggregateTypes select the events to transform, all
+	// events are selected if both are empty.
+	EventTypes     []eh.EventType
+	AggregateTypes []eh.AggregateType
+	// Transform returns the transformed event, or nil to drop the event. It
+	// must return the same result for the same event, as it is called again
+	// for events that are handled twice when a migration is resumed.
+	//
+	// In place only the last events of an aggregate can be dropped, as a gap
+	// in the versions makes the aggregate fail to load. Dropping an event
+	// that is followed by events that are kept fails with ErrMigrationGap,
+	// before any event of the aggregate is dropped. With AggregateSummaries
+	// enabled the summary is updated in the same transaction as the event.
+	Transform func(ctx context.Context, event eh.Event) (eh.Event, error)
+	// TargetTablePrefix is the table prefix to copy all events to, with the
+	// selected events transformed. The events are transformed in place if it
+	// is empty, in which case the transform can not change the aggregate ID
+	// or version of an event. Copying leaves the original table unchanged,
+	// and the store is switched to the new table by changing its config. An
+	// event copied to the key of another event fails with
+	// ErrMigrationConflict.
+	TargetTablePrefix string
+}
+
+// matches returns true if the migration selects the event.
+func (m *Migration) matches(event eh.Event) bool {
+	if len(m.EventTypes) > 0 && !containsEventType(m.EventTypes, event.EventType()) {
+		return false
+	}
+	if len(m.AggregateTypes) > 0 && !containsAggregateType(m.AggregateTypes, event.AggregateType()) {
+		return false
+	}
+	return true
+}
+
+// MigrationResult is the result of a migration.
+type MigrationResult struct {
+	ID string
+	// AlreadyApplied is true if the migration was applied before.
+	AlreadyApplied bool
+	// Scanned is the number of scanned events.
+	Scanned int64
+	// Transformed is the number of transformed events.
+	Transformed int64
+	// Dropped is the number of dropped events.
+	Dropped int64
+	// Copied is the number of events copied unchanged to the target table.
+	Copied int64
+	// Skipped is the number of events already transformed or copied by an
+	// earlier run, or changed by others during the migration.
+	Skipped int64
+}
+
+// MigratorConfig is a config for the Migrator.
+type MigratorConfig struct {
+	// TablePrefix is the prefix of the table of applied migrations, defaults
+	// to "eventhorizonMigrations".
+	TablePrefix string
+	// Progress stores the progress of running migrations, defaults to an
+	// in-memory store. Use a CheckpointStore to resume interrupted migrations
+	// after a restart.
+	Progress JobProgressStore
+	// Segments is the number of table segments scanned in parallel, defaults
+	// to 4.
+	Segments int
+	// PageSize is the max number of items scanned per page, defaults to 100.
+	PageSize int
+}
+
+func (c *MigratorConfig) provideDefaults() {
+	if c.TablePrefix == "" {
+		c.TablePrefix = "eventhorizonMigrations"
+	}
+	if c.Progress == nil {
+		c.Progress = NewMemoryJobProgressStore()
+	}
+	if c.Segments == 0 {
+		c.Segments = 4
+	}
+	if c.PageSize == 0 {
+		c.PageSize = 100
+	}
+}
+
+// Migrator applies migrations to the events of an event store, recording
+// the applied migrations in a table per namespace.
+type Migrator struct {
+	store  *EventStore
+	config *MigratorConfig
+}
+
+// NewMigrator creates a new Migrator for the event store.
+func NewMigrator(store *EventStore, config *MigratorConfig) *Migrator {
+	if config == nil {
+		config = &MigratorConfig{}
+	}
+	config.provideDefaults()
+
+	return &Migrator{
+		store:  store,
+		config: config,
+	}
+}
+
+// Run applies the migrations in order, skipping those that are already
+// applied. It stops at the first migration that fails, which is resumed
+// where it stopped after it is unlocked.
+func (m *Migrator) Run(ctx context.Context, migrations ...*Migration) ([]MigrationResult, error) {
+	var results []MigrationResult
+	for _, migration := range migrations {
+		result, err := m.run(ctx, migration)
+		if err != nil {
+			return results, eh.EventStoreError{
+				BaseErr:   err,
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func (m *Migrator) run(ctx context.Context, migration *Migration) (MigrationResult, error) {
+	result := MigrationResult{ID: migration.ID}
+	if migration.ID == "" || migration.Transform == nil {
+		return result, ErrInvalidMigration
+	}
+
+	// Mark the migration as running, which fails if it has been started.
+	table := m.store.service.Table(m.TableName(ctx))
+	err := table.Put(dbMigration{
+		ID:        migration.ID,
+		Status:    migrationRunning,
+		StartedAt: time.Now(),
+	}).If("attribute_not_exists(ID)").RunWithContext(ctx)
+	if isConditionalCheckFailed(err) {
+		var record dbMigration
+		if err := table.Get("ID", migration.ID).Consistent(true).OneWithContext(ctx, &record); err != nil {
+			return result, err
+		}
+		if record.Status == migrationApplied {
+			result.AlreadyApplied = true
+			return result, nil
+		}
+		return result, ErrMigrationInProgress
+	} else if err != nil {
+		return result, err
+	}
+
+	target := m.store
+	if migration.TargetTablePrefix != "" {
+		if target, err = m.createTarget(ctx, migration.TargetTablePrefix); err != nil {
+			return result, err
+		}
+	}
+
+	scan := &segmentScan{
+		job:      "migration/" + migration.ID,
+		segments: m.config.Segments,
+		pageSize: int64(m.config.PageSize),
+		progress: m.config.Progress,
+	}
+	if target == m.store {
+		scan.filter, scan.names, scan.values = migrationFilter(migration)
+	}
+
+	var mu sync.Mutex
+	err = m.store.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		var r MigrationResult
+		r.Scanned = scanned
+		for _, e := range page {
+			if err := m.migrate(ctx, migration, target, e, &r); err != nil {
+				return err
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		result.Scanned += r.Scanned
+		result.Transformed += r.Transformed
+		result.Dropped += r.Dropped
+		result.Copied += r.Copied
+		result.Skipped += r.Skipped
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	err = table.Update("ID", migration.ID).
+		Set("Status", migrationApplied).
+		Set("AppliedAt", time.Now()).
+		Set("Transformed", result.Transformed).
+		Set("Dropped", result.Dropped).
+		RunWithContext(ctx)
+	return result, err
+}
+
+// migrate transforms or copies one event.
+func (m *Migrator) migrate(ctx context.Context, migration *Migration, target *EventStore, e dbEvent, r *MigrationResult) error {
+	inPlace := target == m.store
+	if inPlace && e.MigrationID == migration.ID {
+		r.Skipped++
+		return nil
+	}
+
+	events, err := m.store.buildEvents(ctx, []dbEvent{e})
+	if err != nil {
+		return err
+	}
+	event := events[0]
+
+	table := target.service.Table(target.TableName(ctx))
+	if !migration.matches(event) {
+		if !inPlace {
+			// Copy the record as is, to keep data without a registered type.
+			record := e
+			record.MigrationID = ""
+			target.setDBEventAttributes(&record)
+			if copied, err := m.copyEvent(ctx, table, &record); err != nil {
+				return err
+			} else if copied {
+				r.Copied++
+			} else {
+				r.Skipped++
+			}
+		}
+		return nil
+	}
+
+	transformed, err := migration.Transform(ctx, event)
+	if err != nil {
+		return err
+	}
+
+	if transformed == nil {
+		if inPlace {
+			if err := m.checkDropAtTail(ctx, migration, e); err != nil {
+				return err
+			}
+
+			summary, err := m.summaryOps(ctx, migration, e, nil)
+			if err != nil {
+				return err
+			}
+			del := table.Delete("AggregateID", e.AggregateID.String()).
+				Range("Version", e.Version).
+				If("EventType = ? AND (attribute_not_exists(MigrationID) OR MigrationID <> ?)", e.EventType, migration.ID)
+			if ok, err := m.store.auditedWrite(ctx, AuditDelete, e.AggregateID, e.Version, del, summary...); err != nil {
+				return err
+			} else if !ok {
+				r.Skipped++
+				return nil
+			}
+		}
+		r.Dropped++
+		return nil
+	}
+
+	if inPlace && (transformed.AggregateID() != event.AggregateID() || transformed.Version() != event.Version()) {
+		return ErrMigrationChangedKey
+	}
+
+	record, err := target.newDBEvent(ctx, transformed)
+	if err != nil {
+		return err
+	}
+	if inPlace {
+		summary, err := m.summaryOps(ctx, migration, e, transformed)
+		if err != nil {
+			return err
+		}
+		record.MigrationID = migration.ID
+		put := table.Put(record).
+			If("EventType = ? AND (attribute_not_exists(MigrationID) OR MigrationID <> ?)", e.EventType, migration.ID)
+		if ok, err := m.store.auditedWrite(ctx, AuditMigrate, e.AggregateID, e.Version, put, summary...); err != nil {
+			return err
+		} else if !ok {
+			r.Skipped++
+			return nil
+		}
+	} else if copied, err := m.copyEvent(ctx, table, record); err != nil {
+		return err
+	} else if !copied {
+		r.Skipped++
+		return nil
+	}
+	r.Transformed++
+
+	return nil
+}
+
+// summaryOps returns the writes that keep the aggregate summary up to date
+// when an event is dropped or transformed in place, or none if summaries are
+// not enabled or the aggregate has none. A dropped event is not counted and
+// the summary version is set to the last event that is kept, or the summary
+// is removed if no event is kept. A transformed event updates the aggregate
+// type, and the timestamps if it is the first or last event.
+func (m *Migrator) summaryOps(ctx context.Context, migration *Migration, e dbEvent, transformed eh.Event) ([]txOp, error) {
+	if !m.store.config.AggregateSummaries {
+		return nil, nil
+	}
+
+	table := m.store.service.Table(m.store.AggregateTableName(ctx))
+	var summary dbAggregate
+	err := table.Get("AggregateID", e.AggregateID.String()).
+		Consistent(true).
+		OneWithContext(ctx, &summary)
+	if err == dynamo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	item := table.Name() + "/" + e.AggregateID.String()
+	desc := fmt.Sprintf("update summary of %s", e.AggregateID)
+	update := table.Update("AggregateID", e.AggregateID.String()).
+		If("attribute_exists(AggregateID)")
+
+	if transformed != nil {
+		update.Set("AggregateType", transformed.AggregateType())
+		if transformed.Version() == 1 {
+			update.Set("CreatedAt", transformed.Timestamp())
+		}
+		if transformed.Version() == summary.Version {
+			update.Set("UpdatedAt", transformed.Timestamp())
+		}
+		return []txOp{updateOp(desc, item, update)}, nil
+	}
+
+	kept, err := m.lastKeptEvent(ctx, migration, e)
+	if err != nil {
+		return nil, err
+	}
+	if kept == nil {
+		del := table.Delete("AggregateID", e.AggregateID.String()).
+			If("attribute_exists(AggregateID)")
+		return []txOp{deleteOp(fmt.Sprintf("remove summary of %s", e.AggregateID), item, del)}, nil
+	}
+	update.Set("Version", kept.Version).
+		Set("UpdatedAt", kept.Timestamp).
+		Add("EventCount", -1)
+
+	return []txOp{updateOp(desc, item, update)}, nil
+}
+
+// lastKeptEvent returns the last event before a dropped event that the
+// migration keeps, or nil if it drops all of them. As only events at the tail
+// are dropped in place, the result is the same in every run.
+func (m *Migrator) lastKeptEvent(ctx context.Context, migration *Migration, e dbEvent) (*dbEvent, error) {
+	table := m.store.service.Table(m.store.TableName(ctx))
+	iter := table.Get("AggregateID", e.AggregateID.String()).
+		Range("Version", dynamo.Less, e.Version).
+		Order(dynamo.Descending).
+		Consistent(true).
+		Iter()
+
+	var earlier dbEvent
+	for iter.NextWithContext(ctx, &earlier) {
+		// Events transformed by an earlier run are kept.
+		if earlier.MigrationID == migration.ID {
+			return &earlier, nil
+		}
+		events, err := m.store.buildEvents(ctx, []dbEvent{earlier})
+		if err != nil {
+			return nil, err
+		}
+		if !migration.matches(events[0]) {
+			return &earlier, nil
+		}
+		if transformed, err := migration.Transform(ctx, events[0]); err != nil {
+			return nil, err
+		} else if transformed != nil {
+			return &earlier, nil
+		}
+		earlier = dbEvent{}
+	}
+
+	return nil, iter.Err()
+}
+
+// checkDropAtTail returns ErrMigrationGap if an event dropped in place is
+// followed by events of the aggregate that the migration keeps.
+func (m *Migrator) checkDropAtTail(ctx context.Context, migration *Migration, e dbEvent) error {
+	table := m.store.service.Table(m.store.TableName(ctx))
+
+	var later []dbEvent
+	err := table.Get("AggregateID", e.AggregateID.String()).
+		Range("Version", dynamo.Greater, e.Version).
+		Consistent(true).
+		AllWithContext(ctx, &later)
+	if err != nil && err != dynamo.ErrNotFound {
+		return err
+	}
+
+	for _, l := range later {
+		// Events transformed by an earlier run are kept.
+		if l.MigrationID == migration.ID {
+			return ErrMigrationGap
+		}
+		events, err := m.store.buildEvents(ctx, []dbEvent{l})
+		if err != nil {
+			return err
+		}
+		if !migration.matches(events[0]) {
+			return ErrMigrationGap
+		}
+		if transformed, err := migration.Transform(ctx, events[0]); err != nil {
+			return err
+		} else if transformed != nil {
+			return ErrMigrationGap
+		}
+	}
+
+	return nil
+}
+
+// copyEvent writes an event to the target table of a copying migration and
+// returns true, or false if the same event was copied by an earlier run. An
+// event with the same key and other content fails with ErrMigrationConflict.
+func (m *Migrator) copyEvent(ctx context.Context, table dynamo.Table, record *dbEvent) (bool, error) {
+	err := table.Put(record).
+		If("attribute_not_exists(AggregateID) AND attribute_not_exists(Version)").
+		RunWithContext(ctx)
+	if !isConditionalCheckFailed(err) {
+		return err == nil, err
+	}
+
+	var existing dbEvent
+	err = table.Get("AggregateID", record.AggregateID.String()).
+		Range("Version", dynamo.Equal, record.Version).
+		Consistent(true).
+		OneWithContext(ctx, &existing)
+	if err != nil {
+		return false, err
+	}
+	if same, err := sameRecords(&existing, record); err != nil {
+		return false, err
+	} else if !same {
+		return false, ErrMigrationConflict
+	}
+
+	return false, nil
+}
+
+// sameRecords returns true if the records have the same attributes.
+func sameRecords(a, b *dbEvent) (bool, error) {
+	itemA, err := dynamo.MarshalItem(a)
+	if err != nil {
+		return false, err
+	}
+	itemB, err := dynamo.MarshalItem(b)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(itemA, itemB), nil
+}
+
+// createTarget creates the target table of a copying migration, if it does
+// not exist from an earlier run, and returns a store for it.
+func (m *Migrator) createTarget(ctx context.Context, tablePrefix string) (*EventStore, error) {
+	config := *m.store.config
+	config.TablePrefix = tablePrefix
+	config.Idempotency = false
+	config.AggregateSummaries = false
+	config.AuditLog = false
+	target := NewEventStoreWithDB(&config, m.store.service)
+
+	_, err := target.service.Table(target.TableName(ctx)).Describe().RunWithContext(ctx)
+	if err, ok := err.(awserr.RequestFailure); ok && err.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		if err := target.CreateTable(ctx); err != nil {
+			return nil, err
+		}
+		return target, nil
+	}
+	return target, err
+}
+
+// Unlock removes the running mark of an interrupted migration, so that it
+// can be resumed. It must only be used when the migration is not running.
+func (m *Migrator) Unlock(ctx context.Context, id string) error {
+	table := m.store.service.Table(m.TableName(ctx))
+	err := table.Delete("ID", id).If("'Status' = ?", migrationRunning).RunWithContext(ctx)
+	if err != nil && !isConditionalCheckFailed(err) {
+		return eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// Applied returns the IDs of all applied migrations.
+func (m *Migrator) Applied(ctx context.Context) ([]string, error) {
+	table := m.store.service.Table(m.TableName(ctx))
+
+	var records []dbMigration
+	if err := table.Scan().Consistent(true).AllWithContext(ctx, &records); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var ids []string
+	for _, r := range records {
+		if r.Status == migrationApplied {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids, nil
+}
+
+// CreateTable creates the migrations table if it is not already existing and
+// correct.
+func (m *Migrator) CreateTable(ctx context.Context) error {
+	if err := m.store.service.CreateTable(m.TableName(ctx), dbMigration{}).Run(); err != nil {
+		return err
+	}
+
+	describeParams := &dynamodb.DescribeTableInput{
+		TableName: aws.String(m.TableName(ctx)),
+	}
+	if err := m.store.service.Client().WaitUntilTableExists(describeParams); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteTable deletes the migrations table.
+func (m *Migrator) DeleteTable(ctx context.Context) error {
+	return m.store.deleteTable(m.TableName(ctx))
+}
+
+// TableName appends the namespace, if one is set, to the table prefix to
+// get the name of the table to use.
+func (m *Migrator) TableName(ctx context.Context) string {
+	ns := eh.NamespaceFromContext(ctx)
+	return m.config.TablePrefix + "_" + ns
+}
+
+// migrationFilter returns a scan filter expression for the event and
+// aggregate types of the migration.
+func migrationFilter(migration *Migration) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	var conds []string
+	names := map[string]*string{}
+	values := map[string]*dynamodb.AttributeValue{}
+
+	if len(migration.EventTypes) > 0 {
+		names["#et"] = aws.String("EventType")
+		var refs []string
+		for i, t := range migration.EventTypes {
+			ref := fmt.Sprintf(":et%d", i)
+			values[ref] = &dynamodb.AttributeValue{S: aws.String(string(t))}
+			refs = append(refs, ref)
+		}
+		conds = append(conds, "#et IN ("+strings.Join(refs, ", ")+")")
+	}
+	if len(migration.AggregateTypes) > 0 {
+		names["#at"] = aws.String("AggregateType")
+		var refs []string
+		for i, t := range migration.AggregateTypes {
+			ref := fmt.Sprintf(":at%d", i)
+			values[ref] = &dynamodb.AttributeValue{S: aws.String(string(t))}
+			refs = append(refs, ref)
+		}
+		conds = append(conds, "#at IN ("+strings.Join(refs, ", ")+")")
+	}
+
+	if len(conds) == 0 {
+		return "", nil, nil
+	}
+	return strings.Join(conds, " AND "), names, values
+}
+
+func containsEventType(types []eh.EventType, t eh.EventType) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAggregateType(types []eh.AggregateType, t eh.AggregateType) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// dbMigration is the record of a migration.
+type dbMigration struct {
+	ID string `dynamo:",hash"`
+
+	Status      string
+	StartedAt   time.Time
+	AppliedAt   time.Time
+	Transformed int64
+	Dropped     int64
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigratorTestSuite struct {
+	suite.Suite
+	store    *EventStore
+	migrator *Migrator
+	id       uuid.UUID
+}
+
+// SetupTest will create the event and migration tables
+func (suite *MigratorTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+
+	suite.migrator = NewMigrator(suite.store, &MigratorConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+	})
+	assert.Nil(suite.T(), suite.migrator.CreateTable(context.Background()), "could not create table")
+
+	suite.id = uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	err = suite.store.Save(context.Background(), []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, suite.id, 1),
+		eh.NewEventForAggregate(mocks.EventOtherType, nil,
+			timestamp, mocks.AggregateType, suite.id, 2),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			timestamp, mocks.AggregateType, suite.id, 3),
+	}, 0)
+	assert.Nil(suite.T(), err)
+}
+
+// TearDownTest will delete the tables
+func (suite *MigratorTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+	assert.Nil(suite.T(), suite.migrator.DeleteTable(context.Background()), "could not delete table")
+}
+
+func uppercase(ctx context.Context, event eh.Event) (eh.Event, error) {
+	data := event.Data().(*mocks.EventData)
+	return eh.NewEventForAggregate(event.EventType(), &mocks.EventData{Content: data.Content + "!"},
+		event.Timestamp(), event.AggregateType(), event.AggregateID(), event.Version()), nil
+}
+
+func (suite *MigratorTestSuite) TestInPlace() {
+	ctx := context.Background()
+	migrations := []*Migration{
+		{
+			ID:         "transform",
+			EventTypes: []eh.EventType{mocks.EventType},
+			Transform:  uppercase,
+		},
+		{
+			ID:         "drop",
+			EventTypes: []eh.EventType{mocks.EventType},
+			Transform: func(ctx context.Context, event eh.Event) (eh.Event, error) {
+				if event.Version() == 3 {
+					return nil, nil
+				}
+				return event, nil
+			},
+		},
+	}
+
+	results, err := suite.migrator.Run(ctx, migrations...)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), results, 2) {
+		assert.Equal(suite.T(), int64(2), results[0].Transformed)
+		assert.Equal(suite.T(), int64(1), results[1].Dropped)
+	}
+
+	events, err := suite.store.Load(ctx, suite.id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 2) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1!"}, events[0].Data())
+		assert.Equal(suite.T(), mocks.EventOtherType, events[1].EventType())
+	}
+
+	// Applied migrations are not run again.
+	results, err = suite.migrator.Run(ctx, migrations...)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), results, 2) {
+		assert.True(suite.T(), results[0].AlreadyApplied)
+		assert.True(suite.T(), results[1].AlreadyApplied)
+	}
+	events, err = suite.store.Load(ctx, suite.id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 2) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1!"}, events[0].Data())
+	}
+
+	applied, err := suite.migrator.Applied(ctx)
+	assert.Nil(suite.T(), err)
+	assert.ElementsMatch(suite.T(), []string{"transform", "drop"}, applied)
+}
+
+func (suite *MigratorTestSuite) TestInPlaceDropGap() {
+	ctx := context.Background()
+	migration := &Migration{
+		ID:         "drop",
+		EventTypes: []eh.EventType{mocks.EventOtherType},
+		Transform: func(ctx context.Context, event eh.Event) (eh.Event, error) {
+			return nil, nil
+		},
+	}
+
+	// Event 3 is kept, so event 2 can not be dropped.
+	_, err := suite.migrator.Run(ctx, migration)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrMigrationGap {
+		suite.T().Error("there should be a migration gap error:", err)
+	}
+
+	events, err := suite.store.Load(ctx, suite.id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 3)
+}
+
+func (suite *MigratorTestSuite) TestInPlaceDropSummary() {
+	ctx := context.Background()
+	store, err := NewEventStore(&EventStoreConfig{
+		TablePrefix:          "eventhorizonTest_" + uuid.New().String(),
+		AggregateTablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:             os.Getenv("DYNAMODB_HOST"),
+		AggregateSummaries:   true,
+	})
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), store.CreateTable(ctx))
+	defer store.DeleteTable(ctx)
+	migrator := NewMigrator(store, &MigratorConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+	})
+	assert.Nil(suite.T(), migrator.CreateTable(ctx))
+	defer migrator.DeleteTable(ctx)
+
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	err = store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventOtherType, nil,
+			timestamp.Add(time.Second), mocks.AggregateType, id, 2),
+		eh.NewEventForAggregate(mocks.EventOtherType, nil,
+			timestamp.Add(time.Minute), mocks.AggregateType, id, 3),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// Drop the tail of the aggregate.
+	results, err := migrator.Run(ctx, &Migration{
+		ID:         "drop",
+		EventTypes: []eh.EventType{mocks.EventOtherType},
+		Transform: func(ctx context.Context, event eh.Event) (eh.Event, error) {
+			return nil, nil
+		},
+	})
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), results, 1) {
+		assert.Equal(suite.T(), int64(2), results[0].Dropped)
+	}
+
+	info, err := store.AggregateInfo(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &AggregateInfo{
+		ID:            id,
+		AggregateType: mocks.AggregateType,
+		Version:       1,
+		EventCount:    1,
+		CreatedAt:     timestamp,
+		UpdatedAt:     timestamp,
+	}, info)
+
+	// The aggregate is saved from the last kept version.
+	err = store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp.Add(time.Hour), mocks.AggregateType, id, 2),
+	}, 1)
+	assert.Nil(suite.T(), err)
+	info, err = store.AggregateInfo(ctx, id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 2, info.Version)
+	assert.Equal(suite.T(), 2, info.EventCount)
+}
+
+func (suite *MigratorTestSuite) TestCopyConflict() {
+	ctx := context.Background()
+	migration := &Migration{
+		ID:         "copy",
+		EventTypes: []eh.EventType{mocks.EventType},
+		// Moves event 3 to the key of event 2.
+		Transform: func(ctx context.Context, event eh.Event) (eh.Event, error) {
+			return eh.NewEventForAggregate(event.EventType(), event.Data(),
+				event.Timestamp(), event.AggregateType(), event.AggregateID(), 2), nil
+		},
+		TargetTablePrefix: "eventhorizonTest_" + uuid.New().String(),
+	}
+
+	_, err := suite.migrator.Run(ctx, migration)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrMigrationConflict {
+		suite.T().Error("there should be a migration conflict error:", err)
+	}
+
+	target, err := NewEventStore(&EventStoreConfig{
+		TablePrefix: migration.TargetTablePrefix,
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), target.DeleteTable(ctx))
+}
+
+func (suite *MigratorTestSuite) TestCopy() {
+	ctx := context.Background()
+	migration := &Migration{
+		ID:                "copy",
+		EventTypes:        []eh.EventType{mocks.EventType},
+		Transform:         uppercase,
+		TargetTablePrefix: "eventhorizonTest_" + uuid.New().String(),
+	}
+
+	results, err := suite.migrator.Run(ctx, migration)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), results, 1) {
+		assert.Equal(suite.T(), int64(2), results[0].Transformed)
+		assert.Equal(suite.T(), int64(1), results[0].Copied)
+	}
+
+	target, err := NewEventStore(&EventStoreConfig{
+		TablePrefix: migration.TargetTablePrefix,
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err)
+	defer target.DeleteTable(ctx)
+
+	events, err := target.Load(ctx, suite.id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 3) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1!"}, events[0].Data())
+		assert.Equal(suite.T(), mocks.EventOtherType, events[1].EventType())
+	}
+
+	// The original events are unchanged.
+	events, err = suite.store.Load(ctx, suite.id)
+	assert.Nil(suite.T(), err)
+	if assert.Len(suite.T(), events, 3) {
+		assert.Equal(suite.T(), &mocks.EventData{Content: "event1"}, events[0].Data())
+	}
+}
+
+func (suite *MigratorTestSuite) TestInProgress() {
+	ctx := context.Background()
+	failing := &Migration{
+		ID: "failing",
+		Transform: func(ctx context.Context, event eh.Event) (eh.Event, error) {
+			return nil, eh.ErrInvalidEvent
+		},
+	}
+	_, err := suite.migrator.Run(ctx, failing)
+	assert.NotNil(suite.T(), err)
+
+	_, err = suite.migrator.Run(ctx, failing)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrMigrationInProgress {
+		suite.T().Error("there should be a migration in progress error:", err)
+	}
+
+	// The migration can be resumed once unlocked.
+	assert.Nil(suite.T(), suite.migrator.Unlock(ctx, "failing"))
+	failing.Transform = uppercase
+	failing.EventTypes = []eh.EventType{mocks.EventType}
+	_, err = suite.migrator.Run(ctx, failing)
+	assert.Nil(suite.T(), err)
+}
+
+// TestMigratorTestSuite starts the test suite
+func TestMigratorTestSuite(t *testing.T) {
+	suite.Run(t, new(MigratorTestSuite))
+}
+
+func TestMigrationFilter(t *testing.T) {
+	filter, names, values := migrationFilter(&Migration{
+		EventTypes:     []eh.EventType{"A", "B"},
+		AggregateTypes: []eh.AggregateType{"C"},
+	})
+	assert.Equal(t, "#et IN (:et0, :et1) AND #at IN (:at0)", filter)
+	assert.Len(t, names, 2)
+	assert.Len(t, values, 3)
+	assert.Equal(t, "B", *values[":et1"].S)
+
+	filter, _, _ = migrationFilter(&Migration{})
+	assert.Equal(t, "", filter)
+}
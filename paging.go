@@ -0,0 +1,56 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/guregu/dynamo"
+)
+
+// ErrInvalidCursor is when a page cursor could not be decoded.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor encodes the last evaluated key of a page as an opaque cursor
+// for the next page. An empty cursor means there are no more pages.
+func encodeCursor(key dynamo.PagingKey) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor decodes a cursor from encodeCursor. An empty cursor is the
+// first page.
+func decodeCursor(cursor string) (dynamo.PagingKey, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var key dynamo.PagingKey
+	if err := json.Unmarshal(b, &key); err != nil || len(key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
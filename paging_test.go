@@ -0,0 +1,50 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/guregu/dynamo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	key := dynamo.PagingKey{
+		"AggregateID": {S: aws.String("2f7a3d4c-a1b2-4c3d-8e9f-0a1b2c3d4e5f")},
+		"Version":     {N: aws.String("3")},
+		"TimeNano":    {N: aws.String("1257894000000000000")},
+	}
+
+	cursor, err := encodeCursor(key)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", cursor)
+	decoded, err := decodeCursor(cursor)
+	assert.Nil(t, err)
+	assert.Equal(t, key, decoded)
+
+	cursor, err = encodeCursor(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", cursor)
+	decoded, err = decodeCursor("")
+	assert.Nil(t, err)
+	assert.Nil(t, decoded)
+
+	_, err = decodeCursor("invalid")
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = decodeCursor("e30")
+	assert.Equal(t, ErrInvalidCursor, err)
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrMissingPartitionKey is when a query is run without a partition key.
+var ErrMissingPartitionKey = errors.New("missing partition key")
+
+// ErrCouldNotQuery is when a query could not be run.
+var ErrCouldNotQuery = errors.New("could not query")
+
+// Query is a fluent query builder over the repo table or one of its global
+// or local secondary indexes. Create one with Repo.Query.
+type Query struct {
+	repo *Repo
+
+	index string
+
+	partitionKey      string
+	partitionKeyValue interface{}
+
+	sortKey       string
+	sortKeyOp     dynamo.Operator
+	sortKeyValues []interface{}
+
+	filters    []queryFilter
+	projection []string
+
+	order      dynamo.Order
+	limit      int64
+	consistent *bool
+}
+
+// Query creates a new query matching all items with the given partition key
+// value. Without a call to Index the query targets the base table.
+func (r *Repo) Query(partitionKey string, value interface{}) *Query {
+	return &Query{
+		repo:              r,
+		partitionKey:      partitionKey,
+		partitionKeyValue: value,
+		order:             dynamo.Ascending,
+	}
+}
+
+// Index makes the query target a global or local secondary index.
+func (q *Query) Index(name string) *Query {
+	q.index = name
+	return q
+}
+
+// Range adds a sort key condition to the query, for example
+// Range("CreatedAt", dynamo.Between, from, to).
+func (q *Query) Range(sortKey string, op dynamo.Operator, values ...interface{}) *Query {
+	q.sortKey = sortKey
+	q.sortKeyOp = op
+	q.sortKeyValues = values
+	return q
+}
+
+// Filter adds a filter expression to the query. Multiple calls are combined
+// with AND.
+func (q *Query) Filter(expr string, args ...interface{}) *Query {
+	q.filters = append(q.filters, queryFilter{expr, args})
+	return q
+}
+
+// Project limits the attributes that are loaded into the entities.
+func (q *Query) Project(paths ...string) *Query {
+	q.projection = append(q.projection, paths...)
+	return q
+}
+
+// Order sets the sort key order of the results, the default is ascending.
+func (q *Query) Order(order dynamo.Order) *Query {
+	q.order = order
+	return q
+}
+
+// Limit sets the maximum number of entities to return.
+func (q *Query) Limit(limit int64) *Query {
+	q.limit = limit
+	return q
+}
+
+// Consistent sets if the query should use strongly consistent reads. Queries
+// on the base table use the read consistency of the context or repo config
+// by default. Queries on an index are eventually consistent by default, as
+// global secondary indexes don't support consistent reads.
+func (q *Query) Consistent(on bool) *Query {
+	q.consistent = &on
+	return q
+}
+
+// All runs the query and returns all matching entities.
+func (q *Query) All(ctx context.Context) ([]eh.Entity, error) {
+	if q.repo.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if q.partitionKey == "" {
+		return nil, eh.RepoError{
+			Err:       ErrMissingPartitionKey,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	iter := q.build(ctx).Iter()
+	result := []eh.Entity{}
+	entity := q.repo.factoryFn()
+	for iter.NextWithContext(ctx, entity) {
+		result = append(result, entity)
+		entity = q.repo.factoryFn()
+	}
+	if err := iter.Err(); err != nil {
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotQuery,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return result, nil
+}
+
+// One runs the query and returns the first matching entity, or
+// eh.ErrEntityNotFound if there is none. The limit of the query is not
+// changed, so that the query can still be used with All.
+func (q *Query) One(ctx context.Context) (eh.Entity, error) {
+	one := *q
+	one.limit = 1
+	entities, err := one.All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 {
+		return nil, eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return entities[0], nil
+}
+
+// build translates the query to a query of the underlying DynamoDB driver.
+func (q *Query) build(ctx context.Context) *dynamo.Query {
+	table := q.repo.service.Table(q.repo.config.TableName)
+	dq := table.Get(q.partitionKey, q.partitionKeyValue)
+
+	if q.index != "" {
+		dq = dq.Index(q.index)
+	}
+	if q.sortKey != "" {
+		dq = dq.Range(q.sortKey, q.sortKeyOp, q.sortKeyValues...)
+	}
+
+	for _, f := range q.filters {
+		dq = dq.Filter(f.expr, f.args...)
+	}
+	if len(q.projection) > 0 {
+		dq = dq.Project(q.projection...)
+	}
+	if q.limit > 0 {
+		dq = dq.Limit(q.limit)
+	}
+
+	consistent := q.index == "" && consistentRead(ctx, q.repo.config.ReadConsistency)
+	if q.consistent != nil {
+		consistent = *q.consistent
+	}
+
+	return dq.Order(q.order).Consistent(consistent)
+}
+
+// queryFilter is a filter expression with its arguments.
+type queryFilter struct {
+	expr string
+	args []interface{}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *RepoTestSuite) TestQueryUsingIndex() {
+	index := dynamo.Index{
+		Name:           "testQueryIndex",
+		HashKey:        "FilterableID",
+		HashKeyType:    dynamo.NumberType,
+		RangeKey:       "FilterableSortKey",
+		RangeKeyType:   dynamo.StringType,
+		ProjectionType: dynamodb.ProjectionTypeAll,
+	}
+	if _, err := suite.db.Table(suite.conf.TableName).UpdateTable().CreateIndex(index).OnDemand(true).Run(); err != nil {
+		suite.T().Fatal("could not create index:", err)
+	}
+	defer suite.db.Table(suite.conf.TableName).UpdateTable().DeleteIndex(index.Name).Run()
+
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "a", FilterableID: 123, FilterableSortKey: "2019-01"})
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "b", FilterableID: 123, FilterableSortKey: "2019-02"})
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "c", FilterableID: 123, FilterableSortKey: "2019-03"})
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "d", FilterableID: 123, FilterableSortKey: "2020-01"})
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "e", FilterableID: 456, FilterableSortKey: "2019-01"})
+
+	results, err := suite.repo.Query("FilterableID", 123).
+		Index(index.Name).
+		Range("FilterableSortKey", dynamo.BeginsWith, "2019").
+		All(context.Background())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, len(results))
+
+	results, err = suite.repo.Query("FilterableID", 123).
+		Index(index.Name).
+		Range("FilterableSortKey", dynamo.Between, "2019-02", "2020-01").
+		Order(dynamo.Descending).
+		All(context.Background())
+	assert.Nil(suite.T(), err)
+	if assert.Equal(suite.T(), 3, len(results)) {
+		assert.Equal(suite.T(), "d", results[0].(*TestModel).Content)
+		assert.Equal(suite.T(), "b", results[2].(*TestModel).Content)
+	}
+
+	results, err = suite.repo.Query("FilterableID", 123).
+		Index(index.Name).
+		Range("FilterableSortKey", dynamo.Greater, "2019-01").
+		Filter("Content <> ?", "c").
+		Project("ID", "FilterableSortKey").
+		Limit(1).
+		All(context.Background())
+	assert.Nil(suite.T(), err)
+	if assert.Equal(suite.T(), 1, len(results)) {
+		assert.Equal(suite.T(), "2019-02", results[0].(*TestModel).FilterableSortKey)
+		assert.Equal(suite.T(), "", results[0].(*TestModel).Content)
+	}
+}
+
+func (suite *RepoTestSuite) TestQueryOne() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test"}
+	_ = suite.repo.Save(context.Background(), testModel)
+
+	result, err := suite.repo.Query("ID", testModel.ID.String()).One(context.Background())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), testModel.ID, result.EntityID())
+
+	result, err = suite.repo.Query("ID", uuid.New().String()).One(context.Background())
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != eh.ErrEntityNotFound || result != nil {
+		suite.T().Fatal("there should be a not found error:", err)
+	}
+}
+
+func TestQueryOneKeepsLimit(t *testing.T) {
+	q := (&Repo{}).Query("ID", uuid.New().String()).Limit(10)
+	_, err := q.One(context.Background())
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrModelNotSet {
+		t.Fatal("there should be a model not set error:", err)
+	}
+	assert.Equal(t, int64(10), q.limit)
+}
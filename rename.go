@@ -0,0 +1,155 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// RenameEventConfig is a config for RenameEventJob.
+type RenameEventConfig struct {
+	// JobID identifies the job in the progress store, defaults to
+	// "rename/<from>/<to>".
+	JobID string
+	// Progress stores the progress of the job, defaults to an in-memory store
+	// which can not resume the job after a restart. Use a CheckpointStore to
+	// resume interrupted jobs.
+	Progress JobProgressStore
+	// Segments is the number of table segments scanned in parallel, defaults
+	// to 4.
+	Segments int
+	// PageSize is the max number of items scanned per page, defaults to 100.
+	PageSize int
+	// DryRun only counts the events to rename, without renaming them or
+	// saving any progress.
+	DryRun bool
+	// OnProgress is called with the totals after every page.
+	OnProgress func(RenameEventProgress)
+}
+
+func (c *RenameEventConfig) provideDefaults(from, to eh.EventType) {
+	if c.JobID == "" {
+		c.JobID = fmt.Sprintf("rename/%s/%s", from, to)
+	}
+	if c.Progress == nil {
+		c.Progress = NewMemoryJobProgressStore()
+	}
+	if c.Segments == 0 {
+		c.Segments = 4
+	}
+	if c.PageSize == 0 {
+		c.PageSize = 100
+	}
+}
+
+// RenameEventProgress is the progress of a rename job. Counts are for the
+// current run only, events renamed before a resume are not counted.
+type RenameEventProgress struct {
+	// Scanned is the number of scanned events.
+	Scanned int64
+	// Matched is the number of events with the old event type.
+	Matched int64
+	// Renamed is the number of renamed events.
+	Renamed int64
+	// Skipped is the number of matched events that were changed by others
+	// before they could be renamed.
+	Skipped int64
+}
+
+// RenameEventJob renames all events of an event type, by scanning the table
+// in parallel segments. The progress is saved after every page, so that an
+// interrupted job continues where it stopped when run again with the same
+// job ID and progress store. Once the job is done its progress is cleared,
+// so that running it again renames the events saved since. Every event is
+// renamed with a condition on its old event type, which makes re-renaming
+// pages safe.
+func (s *EventStore) RenameEventJob(ctx context.Context, from, to eh.EventType, config *RenameEventConfig) (RenameEventProgress, error) {
+	if config == nil {
+		config = &RenameEventConfig{}
+	}
+	config.provideDefaults(from, to)
+
+	scan := &segmentScan{
+		job:           config.JobID,
+		segments:      config.Segments,
+		pageSize:      int64(config.PageSize),
+		progress:      config.Progress,
+		clearWhenDone: true,
+		filter:        "#type = :from",
+		names: map[string]*string{
+			"#type": aws.String("EventType"),
+		},
+		values: map[string]*dynamodb.AttributeValue{
+			":from": {S: aws.String(string(from))},
+		},
+	}
+	if config.DryRun {
+		scan.progress = nil
+	}
+
+	var progress RenameEventProgress
+	var mu sync.Mutex
+	report := func(f func(p *RenameEventProgress)) {
+		mu.Lock()
+		defer mu.Unlock()
+		f(&progress)
+	}
+
+	table := s.service.Table(s.TableName(ctx))
+	err := s.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		var renamed, skipped int64
+		if !config.DryRun {
+			for _, e := range page {
+				update := table.Update("AggregateID", e.AggregateID).
+					Range("Version", e.Version).
+					Set("EventType", to).
+					If("EventType = ?", from)
+				if ok, err := s.auditedWrite(ctx, AuditRename, e.AggregateID, e.Version, update); err != nil {
+					return err
+				} else if ok {
+					renamed++
+				} else {
+					skipped++
+				}
+			}
+		}
+
+		report(func(p *RenameEventProgress) {
+			p.Scanned += scanned
+			p.Matched += int64(len(page))
+			p.Renamed += renamed
+			p.Skipped += skipped
+			if config.OnProgress != nil {
+				config.OnProgress(*p)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return progress, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return progress, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type RenameEventTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event table
+func (suite *RenameEventTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		eventType := mocks.EventType
+		if i%2 == 1 {
+			eventType = mocks.EventOtherType
+		}
+		err := suite.store.Save(context.Background(), []eh.Event{
+			eh.NewEventForAggregate(eventType, nil, timestamp, mocks.AggregateType, uuid.New(), 1),
+		}, 0)
+		assert.Nil(suite.T(), err)
+	}
+}
+
+// TearDownTest will delete the table
+func (suite *RenameEventTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *RenameEventTestSuite) TestDryRun() {
+	var reports int
+	progress, err := suite.store.RenameEventJob(context.Background(), mocks.EventType, "Renamed", &RenameEventConfig{
+		DryRun:     true,
+		PageSize:   2,
+		OnProgress: func(RenameEventProgress) { reports++ },
+	})
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), RenameEventProgress{Scanned: 10, Matched: 5}, progress)
+	assert.True(suite.T(), reports > 0)
+
+	events, err := suite.store.LoadAll(context.Background())
+	assert.Nil(suite.T(), err)
+	for _, e := range events {
+		assert.NotEqual(suite.T(), eh.EventType("Renamed"), e.EventType())
+	}
+}
+
+func (suite *RenameEventTestSuite) TestResume() {
+	ctx := context.Background()
+	store := NewMemoryJobProgressStore()
+
+	// Segment 0 is already done and is not scanned again.
+	assert.Nil(suite.T(), store.SaveProgress(ctx, "job", 0, "", true))
+	config := &RenameEventConfig{
+		JobID:    "job",
+		Progress: store,
+		Segments: 2,
+		PageSize: 3,
+	}
+	progress, err := suite.store.RenameEventJob(ctx, mocks.EventType, "Renamed", config)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), progress.Matched, progress.Renamed)
+	assert.True(suite.T(), progress.Scanned < 10)
+
+	// The rest is renamed after the segment is reset.
+	assert.Nil(suite.T(), store.SaveProgress(ctx, "job", 0, "", false))
+	progress, err = suite.store.RenameEventJob(ctx, mocks.EventType, "Renamed", config)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), progress.Matched, progress.Renamed)
+
+	renamed := 0
+	events, err := suite.store.LoadAll(ctx)
+	assert.Nil(suite.T(), err)
+	for _, e := range events {
+		assert.NotEqual(suite.T(), mocks.EventType, e.EventType())
+		if e.EventType() == "Renamed" {
+			renamed++
+		}
+	}
+	assert.Equal(suite.T(), 5, renamed)
+
+	// The progress is cleared when the job is done, so that running it again
+	// renames new events.
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "new"},
+			time.Now(), mocks.AggregateType, uuid.New(), 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	progress, err = suite.store.RenameEventJob(ctx, mocks.EventType, "Renamed", config)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), RenameEventProgress{Scanned: 11, Matched: 1, Renamed: 1}, progress)
+}
+
+// TestRenameEventTestSuite starts the test suite
+func TestRenameEventTestSuite(t *testing.T) {
+	suite.Run(t, new(RenameEventTestSuite))
+}
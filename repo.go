@@ -17,9 +17,12 @@ package dynamodb
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
 	"github.com/google/uuid"
 	"github.com/guregu/dynamo"
 	eh "github.com/looplab/eventhorizon"
@@ -31,11 +34,27 @@ var ErrCouldNotDialDB = errors.New("could not dial database")
 // ErrModelNotSet is when an model factory is not set on the Repo.
 var ErrModelNotSet = errors.New("model not set")
 
+// ErrConditionFailed is when the condition of a conditional write was not met.
+var ErrConditionFailed = errors.New("condition failed")
+
+// ErrCouldNotRemoveEntity is when entities could not be removed.
+var ErrCouldNotRemoveEntity = errors.New("could not remove entity")
+
 // RepoConfig is a config for the DynamoDB event store.
 type RepoConfig struct {
 	TableName string
 	Region    string
 	Endpoint  string
+
+	// ReadConsistency is the consistency of all reads on the table, defaults
+	// to strongly consistent reads. It can be overridden per call with
+	// NewContextWithConsistency. Queries on indexes are always eventually
+	// consistent unless Query.Consistent is used.
+	ReadConsistency Consistency
+
+	// StrictRemove makes Remove and RemoveIf return eh.ErrEntityNotFound
+	// when the entity did not exist, instead of succeeding silently.
+	StrictRemove bool
 }
 
 func (c *RepoConfig) provideDefaults() {
@@ -47,6 +66,7 @@ func (c *RepoConfig) provideDefaults() {
 // Repo implements a DynamoDB repository for entities.
 type Repo struct {
 	service   *dynamo.DB
+	streams   *dynamodbstreams.DynamoDBStreams
 	config    *RepoConfig
 	factoryFn func() eh.Entity
 }
@@ -68,6 +88,7 @@ func NewRepo(config *RepoConfig) (*Repo, error) {
 
 	return &Repo{
 		service: db,
+		streams: dynamodbstreams.New(sess),
 		config:  config,
 	}, nil
 }
@@ -89,7 +110,7 @@ func (r *Repo) Find(ctx context.Context, id uuid.UUID) (eh.Entity, error) {
 	table := r.service.Table(r.config.TableName)
 	entity := r.factoryFn()
 
-	err := table.Get("ID", id.String()).Consistent(true).One(entity)
+	err := table.Get("ID", id.String()).Consistent(consistentRead(ctx, r.config.ReadConsistency)).One(entity)
 
 	if err != nil {
 		return nil, eh.RepoError{
@@ -113,7 +134,7 @@ func (r *Repo) FindAll(ctx context.Context) ([]eh.Entity, error) {
 
 	table := r.service.Table(r.config.TableName)
 
-	iter := table.Scan().Consistent(true).Iter()
+	iter := table.Scan().Consistent(consistentRead(ctx, r.config.ReadConsistency)).Iter()
 	result := []eh.Entity{}
 	entity := r.factoryFn()
 	for iter.Next(entity) {
@@ -135,7 +156,7 @@ func (r *Repo) FindWithFilter(ctx context.Context, expr string, args ...interfac
 
 	table := r.service.Table(r.config.TableName)
 
-	iter := table.Scan().Filter(expr, args...).Consistent(true).Iter()
+	iter := table.Scan().Filter(expr, args...).Consistent(consistentRead(ctx, r.config.ReadConsistency)).Iter()
 	result := []eh.Entity{}
 	entity := r.factoryFn()
 	for iter.Next(entity) {
@@ -155,26 +176,48 @@ func (r *Repo) FindWithFilterUsingIndex(ctx context.Context, indexInput IndexInp
 		}
 	}
 
-	table := r.service.Table(r.config.TableName)
-
-	iter := table.Get(indexInput.PartitionKey, indexInput.PartitionKeyValue).
+	return r.Query(indexInput.PartitionKey, indexInput.PartitionKeyValue).
 		Range(indexInput.SortKey, dynamo.Equal, indexInput.SortKeyValue).
 		Index(indexInput.IndexName).
 		Filter(filterQuery, filterArgs...).
-		Iter()
+		All(ctx)
+}
 
-	result := []eh.Entity{}
-	entity := r.factoryFn()
-	for iter.Next(entity) {
-		result = append(result, entity)
-		entity = r.factoryFn()
+// Save implements the Save method of the eventhorizon.WriteRepo interface.
+func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+	table := r.service.Table(r.config.TableName)
+
+	if entity.EntityID() == uuid.Nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   eh.ErrMissingEntityID,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
 	}
 
-	return result, nil
+	put := table.Put(entity)
+
+	// Defer the write to the transaction if there is one.
+	if tx := TxFromContext(ctx); tx != nil {
+		tx.put(fmt.Sprintf("save entity %s in %s", entity.EntityID(), table.Name()), put)
+		return nil
+	}
+
+	if err := put.RunWithContext(ctx); err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrCouldNotSaveEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
 }
 
-// Save implements the Save method of the eventhorizon.WriteRepo interface.
-func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
+// SaveIf saves the entity if the condition is met, otherwise it returns
+// ErrConditionFailed. Use "attribute_not_exists(ID)" for create-only
+// semantics.
+func (r *Repo) SaveIf(ctx context.Context, entity eh.Entity, expr string, args ...interface{}) error {
 	table := r.service.Table(r.config.TableName)
 
 	if entity.EntityID() == uuid.Nil {
@@ -185,7 +228,22 @@ func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
 		}
 	}
 
-	if err := table.Put(entity).Run(); err != nil {
+	put := table.Put(entity).If(expr, args...)
+
+	// Defer the write to the transaction if there is one.
+	if tx := TxFromContext(ctx); tx != nil {
+		tx.put(fmt.Sprintf("save entity %s in %s", entity.EntityID(), table.Name()), put)
+		return nil
+	}
+
+	if err := put.RunWithContext(ctx); err != nil {
+		if isConditionalCheckFailed(err) {
+			return eh.RepoError{
+				Err:       ErrConditionFailed,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
 		return eh.RepoError{
 			Err:       eh.ErrCouldNotSaveEntity,
 			BaseErr:   err,
@@ -200,7 +258,48 @@ func (r *Repo) Save(ctx context.Context, entity eh.Entity) error {
 func (r *Repo) Remove(ctx context.Context, id uuid.UUID) error {
 	table := r.service.Table(r.config.TableName)
 
-	if err := table.Delete("ID", id.String()).Run(); err != nil {
+	del := table.Delete("ID", id.String())
+	if r.config.StrictRemove {
+		del = del.If("attribute_exists(ID)")
+	}
+
+	// Defer the write to the transaction if there is one.
+	if tx := TxFromContext(ctx); tx != nil {
+		tx.delete(fmt.Sprintf("remove entity %s in %s", id, table.Name()), del)
+		return nil
+	}
+
+	if err := del.RunWithContext(ctx); err != nil {
+		return eh.RepoError{
+			Err:       eh.ErrEntityNotFound,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return nil
+}
+
+// RemoveIf removes the entity if the condition is met, otherwise it returns
+// ErrConditionFailed.
+func (r *Repo) RemoveIf(ctx context.Context, id uuid.UUID, expr string, args ...interface{}) error {
+	table := r.service.Table(r.config.TableName)
+
+	del := table.Delete("ID", id.String()).If(expr, args...)
+	if r.config.StrictRemove {
+		del = del.If("attribute_exists(ID)")
+	}
+
+	// Defer the write to the transaction if there is one.
+	if tx := TxFromContext(ctx); tx != nil {
+		tx.delete(fmt.Sprintf("remove entity %s in %s", id, table.Name()), del)
+		return nil
+	}
+
+	if err := del.RunWithContext(ctx); err != nil {
+		if isConditionalCheckFailed(err) {
+			return r.conditionError(ctx, id, err, r.config.StrictRemove)
+		}
 		return eh.RepoError{
 			Err:       eh.ErrEntityNotFound,
 			BaseErr:   err,
@@ -216,6 +315,37 @@ func (r *Repo) SetEntityFactory(f func() eh.Entity) {
 	r.factoryFn = f
 }
 
+// conditionError returns the error for a failed condition. If checkExists
+// is set it finds out if the failure was caused by a missing entity.
+func (r *Repo) conditionError(ctx context.Context, id uuid.UUID, err error, checkExists bool) error {
+	if checkExists {
+		table := r.service.Table(r.config.TableName)
+		count, countErr := table.Get("ID", id.String()).Consistent(true).CountWithContext(ctx)
+		if countErr == nil && count == 0 {
+			return eh.RepoError{
+				Err:       eh.ErrEntityNotFound,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}
+
+	return eh.RepoError{
+		Err:       ErrConditionFailed,
+		BaseErr:   err,
+		Namespace: eh.NamespaceFromContext(ctx),
+	}
+}
+
+// isConditionalCheckFailed returns true if the error is caused by a condition
+// expression that was not met.
+func isConditionalCheckFailed(err error) bool {
+	if err, ok := err.(awserr.RequestFailure); ok && err.Code() == "ConditionalCheckFailedException" {
+		return true
+	}
+	return false
+}
+
 // IndexInput is all the params we need to filter on an index
 type IndexInput struct {
 	IndexName         string
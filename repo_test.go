@@ -18,6 +18,7 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -110,6 +111,22 @@ func (suite *RepoTestSuite) TestSaveAndFind() {
 	assert.Equal(suite.T(), testModel.ID, result.EntityID())
 }
 
+func (suite *RepoTestSuite) TestFindEventuallyConsistent() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test"}
+	_ = suite.repo.Save(context.Background(), testModel)
+
+	// Eventually consistent reads may be stale for a short while.
+	ctx := NewContextWithConsistency(context.Background(), EventualConsistency)
+	for i := 0; i < 50; i++ {
+		if result, err := suite.repo.Find(ctx, testModel.ID); err == nil {
+			assert.Equal(suite.T(), testModel.ID, result.EntityID())
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	suite.T().Fatal("the entity should eventually be found")
+}
+
 func (suite *RepoTestSuite) TestSaveAndFindAll() {
 	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "test"})
 	_ = suite.repo.Save(context.Background(), &TestModel{ID: uuid.New(), Content: "test2"})
@@ -184,6 +201,57 @@ func (suite *RepoTestSuite) TestRemove() {
 	}
 }
 
+func (suite *RepoTestSuite) TestSaveIf() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test"}
+
+	err := suite.repo.SaveIf(context.Background(), testModel, "attribute_not_exists(ID)")
+	if err != nil {
+		suite.T().Fatal("error saving entity:", err)
+	}
+
+	err = suite.repo.SaveIf(context.Background(), testModel, "attribute_not_exists(ID)")
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrConditionFailed {
+		suite.T().Fatal("there should be a condition failed error:", err)
+	}
+}
+
+func (suite *RepoTestSuite) TestRemoveIf() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test"}
+	_ = suite.repo.Save(context.Background(), testModel)
+
+	err := suite.repo.RemoveIf(context.Background(), testModel.ID, "Content = ?", "other")
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrConditionFailed {
+		suite.T().Fatal("there should be a condition failed error:", err)
+	}
+
+	err = suite.repo.RemoveIf(context.Background(), testModel.ID, "Content = ?", "test")
+	if err != nil {
+		suite.T().Fatal("failed to remove entity:", err)
+	}
+}
+
+func (suite *RepoTestSuite) TestStrictRemove() {
+	conf := *suite.conf
+	conf.StrictRemove = true
+	repo, err := NewRepo(&conf)
+	if err != nil {
+		suite.T().Fatal("error creating repo:", err)
+	}
+
+	err = repo.Remove(context.Background(), uuid.New())
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != eh.ErrEntityNotFound {
+		suite.T().Fatal("there should be a not found error:", err)
+	}
+
+	err = repo.RemoveIf(context.Background(), uuid.New(), "Content = ?", "test")
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != eh.ErrEntityNotFound {
+		suite.T().Fatal("there should be a not found error:", err)
+	}
+
+	// The non strict repo silently succeeds.
+	assert.Nil(suite.T(), suite.repo.Remove(context.Background(), uuid.New()))
+}
+
 func (suite *RepoTestSuite) TestNoFactoryFn() {
 	suite.repo.SetEntityFactory(nil)
 	result, err := suite.repo.Find(context.Background(), uuid.New())
@@ -212,6 +280,8 @@ type TestModel struct {
 	Content           string
 	FilterableID      int
 	FilterableSortKey string
+	Counter           int
+	Tags              []string
 }
 
 // EntityID implements the EntityID method of the eventhorizon.Entity interface.
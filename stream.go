@@ -0,0 +1,314 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/guregu/dynamo"
+)
+
+// ErrStreamNotEnabled is when a stream is read from a table without a stream.
+var ErrStreamNotEnabled = errors.New("stream not enabled")
+
+// ErrCouldNotReadStream is when a stream could not be read.
+var ErrCouldNotReadStream = errors.New("could not read stream")
+
+// StreamCheckpointer stores how far a stream consumer has read each shard of
+// a stream, so that it can resume after a restart.
+type StreamCheckpointer interface {
+	// LastSequenceNumber returns the sequence number of the last processed
+	// record of the shard, or an empty string if there is none.
+	LastSequenceNumber(ctx context.Context, shardID string) (string, error)
+
+	// SetSequenceNumber stores the sequence number of the last processed
+	// record of the shard.
+	SetSequenceNumber(ctx context.Context, shardID, sequenceNumber string) error
+}
+
+// MemoryStreamCheckpointer is a StreamCheckpointer that keeps the positions
+// in memory, useful for tests and consumers that always start over.
+type MemoryStreamCheckpointer struct {
+	positions   map[string]string
+	positionsMu sync.RWMutex
+}
+
+// NewMemoryStreamCheckpointer creates a new MemoryStreamCheckpointer.
+func NewMemoryStreamCheckpointer() *MemoryStreamCheckpointer {
+	return &MemoryStreamCheckpointer{
+		positions: map[string]string{},
+	}
+}
+
+// LastSequenceNumber implements the LastSequenceNumber method of the
+// StreamCheckpointer interface.
+func (c *MemoryStreamCheckpointer) LastSequenceNumber(ctx context.Context, shardID string) (string, error) {
+	c.positionsMu.RLock()
+	defer c.positionsMu.RUnlock()
+	return c.positions[shardID], nil
+}
+
+// SetSequenceNumber implements the SetSequenceNumber method of the
+// StreamCheckpointer interface.
+func (c *MemoryStreamCheckpointer) SetSequenceNumber(ctx context.Context, shardID, sequenceNumber string) error {
+	c.positionsMu.Lock()
+	defer c.positionsMu.Unlock()
+	c.positions[shardID] = sequenceNumber
+	return nil
+}
+
+// streamShard is the read state of a shard.
+type streamShard struct {
+	parentID string
+	iterator *string
+	started  bool
+	done     bool
+}
+
+// streamReader tails all shards of a DynamoDB stream, handing every record
+// to a handler and checkpointing it once handled. Parent shards are read
+// before their children to keep the order of changes per item.
+type streamReader struct {
+	client       dynamodbstreamsiface.DynamoDBStreamsAPI
+	streamARN    string
+	checkpointer StreamCheckpointer
+	pollInterval time.Duration
+	fromLatest   bool
+	// describeInterval is how often the stream is described to find new
+	// shards, as DescribeStream has a low request limit. It is also
+	// described when a shard is finished, as its children are added then.
+	describeInterval time.Duration
+
+	shards      map[string]*streamShard
+	describedAt time.Time
+	closed      bool
+}
+
+// newStreamReader creates a reader for the latest stream of the table.
+func newStreamReader(ctx context.Context, db *dynamo.DB, client dynamodbstreamsiface.DynamoDBStreamsAPI, tableName string) (*streamReader, error) {
+	desc, err := db.Table(tableName).Describe().RunWithContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !desc.StreamEnabled || desc.LatestStreamARN == "" {
+		return nil, ErrStreamNotEnabled
+	}
+
+	return &streamReader{
+		client:           client,
+		streamARN:        desc.LatestStreamARN,
+		checkpointer:     NewMemoryStreamCheckpointer(),
+		pollInterval:     time.Second,
+		describeInterval: time.Minute,
+		shards:           map[string]*streamShard{},
+	}, nil
+}
+
+// run reads the stream until the context is canceled or an error occurs.
+func (sr *streamReader) run(ctx context.Context, handle func(context.Context, *dynamodbstreams.Record) error) error {
+	first := true
+	for {
+		if first || sr.closed || time.Since(sr.describedAt) >= sr.describeInterval {
+			if err := sr.describe(ctx, first); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			sr.describedAt = time.Now()
+			sr.closed = false
+		}
+		first = false
+
+		read := 0
+		for _, id := range sr.readableShards() {
+			n, err := sr.readShard(ctx, id, handle)
+			if err != nil {
+				return err
+			}
+			read += n
+		}
+
+		// Only wait if there was nothing to read.
+		if read == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(sr.pollInterval):
+			}
+		} else if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// describe adds all new shards of the stream.
+func (sr *streamReader) describe(ctx context.Context, first bool) error {
+	input := &dynamodbstreams.DescribeStreamInput{
+		StreamArn: aws.String(sr.streamARN),
+	}
+	for {
+		out, err := sr.client.DescribeStreamWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range out.StreamDescription.Shards {
+			id := aws.StringValue(s.ShardId)
+			if _, ok := sr.shards[id]; ok {
+				continue
+			}
+			shard := &streamShard{
+				parentID: aws.StringValue(s.ParentShardId),
+			}
+			if first && sr.fromLatest {
+				if err := sr.skipToLatest(ctx, id, s, shard); err != nil {
+					return err
+				}
+			}
+			sr.shards[id] = shard
+		}
+
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			return nil
+		}
+		input.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// skipToLatest makes a shard without a checkpoint skip all existing records,
+// by starting open shards at the latest record and finishing closed ones.
+func (sr *streamReader) skipToLatest(ctx context.Context, id string, s *dynamodbstreams.Shard, shard *streamShard) error {
+	seq, err := sr.checkpointer.LastSequenceNumber(ctx, id)
+	if err != nil || seq != "" {
+		return err
+	}
+
+	if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+		shard.done = true
+		return nil
+	}
+
+	shard.iterator, err = sr.iterator(ctx, id, dynamodbstreams.ShardIteratorTypeLatest, "")
+	if err != nil {
+		return err
+	}
+	shard.started = true
+
+	return nil
+}
+
+// readableShards returns the IDs of all unfinished shards whose parent is
+// finished or no longer part of the stream, in order.
+func (sr *streamReader) readableShards() []string {
+	ids := []string{}
+	for id, shard := range sr.shards {
+		if shard.done {
+			continue
+		}
+		if parent, ok := sr.shards[shard.parentID]; ok && !parent.done {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// readShard reads one batch of records of the shard and returns the number
+// of handled records.
+func (sr *streamReader) readShard(ctx context.Context, id string, handle func(context.Context, *dynamodbstreams.Record) error) (int, error) {
+	shard := sr.shards[id]
+
+	// Resume from the checkpoint, or the oldest record in the shard.
+	if !shard.started {
+		seq, err := sr.checkpointer.LastSequenceNumber(ctx, id)
+		if err != nil {
+			return 0, err
+		}
+		if seq != "" {
+			shard.iterator, err = sr.iterator(ctx, id, dynamodbstreams.ShardIteratorTypeAfterSequenceNumber, seq)
+		} else {
+			shard.iterator, err = sr.iterator(ctx, id, dynamodbstreams.ShardIteratorTypeTrimHorizon, "")
+		}
+		if err != nil {
+			return 0, err
+		}
+		shard.started = true
+	}
+	if shard.iterator == nil {
+		shard.done = true
+		sr.closed = true
+		return 0, nil
+	}
+
+	out, err := sr.client.GetRecordsWithContext(ctx, &dynamodbstreams.GetRecordsInput{
+		ShardIterator: shard.iterator,
+	})
+	if err != nil {
+		// Restart from the checkpoint on expired iterators.
+		if err, ok := err.(awserr.Error); ok && err.Code() == dynamodbstreams.ErrCodeExpiredIteratorException {
+			shard.started = false
+			return 0, nil
+		}
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for _, record := range out.Records {
+		if err := handle(ctx, record); err != nil {
+			return 0, err
+		}
+		if err := sr.checkpointer.SetSequenceNumber(ctx, id, aws.StringValue(record.Dynamodb.SequenceNumber)); err != nil {
+			return 0, err
+		}
+	}
+
+	shard.iterator = out.NextShardIterator
+	if shard.iterator == nil {
+		shard.done = true
+		sr.closed = true
+	}
+
+	return len(out.Records), nil
+}
+
+func (sr *streamReader) iterator(ctx context.Context, shardID, iteratorType, seq string) (*string, error) {
+	input := &dynamodbstreams.GetShardIteratorInput{
+		StreamArn:         aws.String(sr.streamARN),
+		ShardId:           aws.String(shardID),
+		ShardIteratorType: aws.String(iteratorType),
+	}
+	if seq != "" {
+		input.SequenceNumber = aws.String(seq)
+	}
+
+	out, err := sr.client.GetShardIteratorWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+
+	return out.ShardIterator, nil
+}
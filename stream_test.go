@@ -0,0 +1,98 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams/dynamodbstreamsiface"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStreams is a stream without records, whose first shard is closed and
+// split after a number of reads. The context is canceled after stopAt reads.
+type fakeStreams struct {
+	dynamodbstreamsiface.DynamoDBStreamsAPI
+	describes int
+	reads     int
+	closeAt   int
+	stopAt    int
+	cancel    func()
+}
+
+func (f *fakeStreams) DescribeStreamWithContext(ctx aws.Context, input *dynamodbstreams.DescribeStreamInput, opts ...request.Option) (*dynamodbstreams.DescribeStreamOutput, error) {
+	f.describes++
+	shards := []*dynamodbstreams.Shard{
+		{ShardId: aws.String("shard-1")},
+	}
+	if f.reads >= f.closeAt {
+		shards = append(shards, &dynamodbstreams.Shard{
+			ShardId:       aws.String("shard-2"),
+			ParentShardId: aws.String("shard-1"),
+		})
+	}
+	return &dynamodbstreams.DescribeStreamOutput{
+		StreamDescription: &dynamodbstreams.StreamDescription{
+			Shards: shards,
+		},
+	}, nil
+}
+
+func (f *fakeStreams) GetShardIteratorWithContext(ctx aws.Context, input *dynamodbstreams.GetShardIteratorInput, opts ...request.Option) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	return &dynamodbstreams.GetShardIteratorOutput{
+		ShardIterator: aws.String("iterator"),
+	}, nil
+}
+
+func (f *fakeStreams) GetRecordsWithContext(ctx aws.Context, input *dynamodbstreams.GetRecordsInput, opts ...request.Option) (*dynamodbstreams.GetRecordsOutput, error) {
+	f.reads++
+	if f.reads == f.stopAt {
+		f.cancel()
+	}
+	out := &dynamodbstreams.GetRecordsOutput{}
+	if f.reads != f.closeAt {
+		out.NextShardIterator = aws.String("iterator")
+	}
+	return out, nil
+}
+
+func TestStreamReaderDescribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &fakeStreams{closeAt: 5, stopAt: 20, cancel: cancel}
+	sr := &streamReader{
+		client:           client,
+		streamARN:        "arn",
+		checkpointer:     NewMemoryStreamCheckpointer(),
+		pollInterval:     time.Millisecond,
+		describeInterval: time.Hour,
+		shards:           map[string]*streamShard{},
+	}
+
+	handle := func(ctx context.Context, record *dynamodbstreams.Record) error {
+		return nil
+	}
+	assert.Nil(t, sr.run(ctx, handle))
+
+	// Described at the start and once more when the first shard closed.
+	assert.Equal(t, 2, client.describes)
+	assert.True(t, sr.shards["shard-1"].done)
+	assert.Contains(t, sr.shards, "shard-2")
+}
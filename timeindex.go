@@ -0,0 +1,155 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrTimeIndexNotEnabled is when events are loaded by time range but the
+// time index is not enabled in the config.
+var ErrTimeIndexNotEnabled = errors.New("time index not enabled")
+
+// timeIndex is the global secondary index of events by time bucket, sorted
+// by the timestamp in Unix nanoseconds.
+var timeIndex = dynamo.Index{
+	Name:         "TimeIndex",
+	HashKey:      "TimeBucket",
+	HashKeyType:  dynamo.StringType,
+	RangeKey:     "TimeNano",
+	RangeKeyType: dynamo.NumberType,
+}
+
+// maxTimeBucketQueries is the max number of buckets that are queried in
+// parallel by LoadByTimeRange.
+const maxTimeBucketQueries = 16
+
+// LoadByTimeRange loads all events with a timestamp from and including from
+// up to but not including to, sorted by timestamp. The buckets of the range
+// are queried in parallel. Only events saved with TimeIndex enabled are
+// found, and as the index is a global secondary index the reads are always
+// eventually consistent.
+func (s *EventStore) LoadByTimeRange(ctx context.Context, from, to time.Time) ([]eh.Event, error) {
+	if !s.config.TimeIndex {
+		return nil, eh.EventStoreError{
+			Err:       ErrTimeIndexNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if !from.Before(to) {
+		return []eh.Event{}, nil
+	}
+
+	buckets := timeBuckets(from, to, s.config.TimeBucketSize)
+	results := make([][]dbEvent, len(buckets))
+
+	// The first failed query cancels the others, its error is the one
+	// returned.
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	var errMu sync.Mutex
+
+	table := s.service.Table(s.TableName(ctx))
+	sem := make(chan struct{}, maxTimeBucketQueries)
+	var wg sync.WaitGroup
+	for i, bucket := range buckets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, bucket string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := table.Get("TimeBucket", bucket).
+				Index(timeIndex.Name).
+				Range("TimeNano", dynamo.Between, from.UnixNano(), to.UnixNano()-1).
+				AllWithContext(ctx, &results[i])
+			if err != nil && err != dynamo.ErrNotFound {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+				cancel()
+			}
+		}(i, bucket)
+	}
+	wg.Wait()
+
+	if err := parent.Err(); err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	if firstErr != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   firstErr,
+			Err:       ErrCouldNotQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	var dbEvents []dbEvent
+	for _, r := range results {
+		dbEvents = append(dbEvents, r...)
+	}
+	sortDBEvents(dbEvents)
+
+	return s.buildEvents(ctx, dbEvents)
+}
+
+// timeBucket returns the bucket of a timestamp, as the start of the bucket in
+// UTC.
+func timeBucket(t time.Time, size time.Duration) string {
+	return t.UTC().Truncate(size).Format(time.RFC3339)
+}
+
+// timeBuckets returns all buckets overlapping the range from and including
+// from up to but not including to.
+func timeBuckets(from, to time.Time, size time.Duration) []string {
+	var buckets []string
+	for t := from.UTC().Truncate(size); t.Before(to); t = t.Add(size) {
+		buckets = append(buckets, timeBucket(t, size))
+	}
+	return buckets
+}
+
+// sortDBEvents sorts events by timestamp, with events with the same
+// timestamp sorted by aggregate ID and version to get a stable order.
+func sortDBEvents(dbEvents []dbEvent) {
+	sort.Slice(dbEvents, func(i, j int) bool {
+		a, b := dbEvents[i], dbEvents[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		if c := bytes.Compare(a.AggregateID[:], b.AggregateID[:]); c != 0 {
+			return c < 0
+		}
+		return a.Version < b.Version
+	})
+}
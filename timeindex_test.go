@@ -0,0 +1,137 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TimeIndexTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event table with the time index
+func (suite *TimeIndexTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+		TimeIndex:   true,
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the table
+func (suite *TimeIndexTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *TimeIndexTestSuite) TestLoadByTimeRange() {
+	ctx := context.Background()
+	start := time.Date(2009, time.November, 10, 9, 30, 0, 0, time.UTC)
+
+	id1, id2 := uuid.New(), uuid.New()
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			start, mocks.AggregateType, id1, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			start.Add(time.Hour), mocks.AggregateType, id1, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	err = suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			start.Add(45*time.Minute), mocks.AggregateType, id2, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event4"},
+			start.Add(2*time.Hour), mocks.AggregateType, id2, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// The range spans three buckets, excluding the last event.
+	var events []eh.Event
+	for i := 0; i < 10; i++ {
+		events, err = suite.store.LoadByTimeRange(ctx, start, start.Add(2*time.Hour))
+		assert.Nil(suite.T(), err)
+		if len(events) == 3 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if assert.Len(suite.T(), events, 3) {
+		assert.Equal(suite.T(), "event1", events[0].Data().(*mocks.EventData).Content)
+		assert.Equal(suite.T(), "event3", events[1].Data().(*mocks.EventData).Content)
+		assert.Equal(suite.T(), "event2", events[2].Data().(*mocks.EventData).Content)
+	}
+
+	events, err = suite.store.LoadByTimeRange(ctx, start.Add(3*time.Hour), start.Add(4*time.Hour))
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 0)
+}
+
+// TestTimeIndexTestSuite starts the test suite
+func TestTimeIndexTestSuite(t *testing.T) {
+	suite.Run(t, new(TimeIndexTestSuite))
+}
+
+func TestTimeBuckets(t *testing.T) {
+	from := time.Date(2009, time.November, 10, 9, 30, 0, 0, time.UTC)
+
+	assert.Equal(t, []string{
+		"2009-11-10T09:00:00Z",
+		"2009-11-10T10:00:00Z",
+		"2009-11-10T11:00:00Z",
+	}, timeBuckets(from, from.Add(2*time.Hour), time.Hour))
+	assert.Equal(t, []string{
+		"2009-11-10T09:00:00Z",
+	}, timeBuckets(from, from.Add(30*time.Minute), time.Hour))
+
+	// Buckets are always in UTC.
+	local := from.In(time.FixedZone("CET", 3600))
+	assert.Equal(t, "2009-11-10T09:00:00Z", timeBucket(local, time.Hour))
+}
+
+func TestLoadByTimeRangeCanceled(t *testing.T) {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String("http://127.0.0.1:1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	assert.Nil(t, err)
+	store := NewEventStoreWithDB(&EventStoreConfig{TimeIndex: true}, dynamo.New(sess))
+
+	// A canceled caller gets the cancellation, not partial results.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	from := time.Date(2009, time.November, 10, 9, 30, 0, 0, time.UTC)
+	events, err := store.LoadByTimeRange(ctx, from, from.Add(3*time.Hour))
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != context.Canceled {
+		t.Error("there should be a canceled error:", err)
+	}
+	assert.Nil(t, events)
+}
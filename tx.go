@@ -0,0 +1,295 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+)
+
+// ErrTxCanceled is when a transaction was canceled by DynamoDB, for example
+// because of a failed condition.
+var ErrTxCanceled = errors.New("transaction canceled")
+
+// ErrCouldNotCommitTx is when a transaction could not be committed.
+var ErrCouldNotCommitTx = errors.New("could not commit transaction")
+
+// ErrTxAlreadyCommitted is when a transaction is committed more than once.
+var ErrTxAlreadyCommitted = errors.New("transaction already committed")
+
+// ErrTxTooLarge is when a transaction has more than MaxTxItems operations.
+var ErrTxTooLarge = errors.New("transaction too large")
+
+// ErrTxDuplicateItem is when an item is written more than once in a
+// transaction, which DynamoDB does not allow.
+var ErrTxDuplicateItem = errors.New("item written twice in transaction")
+
+// MaxTxItems is the max number of operations in a transaction, the limit of
+// DynamoDB.
+const MaxTxItems = 100
+
+// TxError is an error when committing a transaction.
+type TxError struct {
+	// Err is the error.
+	Err error
+	// BaseErr is an optional underlying error, for example from the DB driver.
+	BaseErr error
+	// Reasons are the cancellation reasons, one per operation in the order
+	// they were added, if the transaction was canceled.
+	Reasons []TxCancellationReason
+}
+
+// Error implements the Error method of the errors.Error interface.
+func (e TxError) Error() string {
+	errStr := e.Err.Error()
+	if e.BaseErr != nil {
+		errStr += ": " + e.BaseErr.Error()
+	}
+	for _, r := range e.Reasons {
+		if r.Code != "" && r.Code != "None" {
+			errStr += fmt.Sprintf(" [%d %s: %s]", r.Index, r.Operation, r.Code)
+		}
+	}
+	return errStr
+}
+
+// TxCancellationReason is the reason for an operation in a canceled
+// transaction. Code is "None" for operations that did not fail.
+type TxCancellationReason struct {
+	Index     int
+	Operation string
+	Code      string
+}
+
+// Tx is a write transaction that can span the event store and repo tables.
+// Add it to a context with NewContextWithTx to make EventStore.Save,
+// Repo.Save, Repo.SaveIf, Repo.Update, Repo.Remove and Repo.RemoveIf add
+// their writes to the transaction instead of running them directly. All
+// writes are then applied atomically by Commit.
+type Tx struct {
+	db        *dynamo.DB
+	ops       []txOp
+	committed bool
+	mu        sync.Mutex
+}
+
+// txOp is an operation in a transaction, with a description for errors.
+type txOp struct {
+	desc string
+	add  func(*dynamo.WriteTx)
+	// item is the table and key of the written item, if it is known.
+	item string
+}
+
+// NewTx creates a new transaction that is committed using the DB.
+func NewTx(db *dynamo.DB) *Tx {
+	return &Tx{
+		db: db,
+	}
+}
+
+// NewTx creates a new transaction using the DB of the event store.
+func (s *EventStore) NewTx() *Tx {
+	return NewTx(s.service)
+}
+
+// NewTx creates a new transaction using the DB of the repo.
+func (r *Repo) NewTx() *Tx {
+	return NewTx(r.service)
+}
+
+type txContextKey int
+
+const txKey txContextKey = iota
+
+// NewContextWithTx returns the context with the transaction set.
+func NewContextWithTx(ctx context.Context, tx *Tx) context.Context {
+	return context.WithValue(ctx, txKey, tx)
+}
+
+// TxFromContext returns the transaction from the context, or nil if there is
+// none.
+func TxFromContext(ctx context.Context) *Tx {
+	tx, _ := ctx.Value(txKey).(*Tx)
+	return tx
+}
+
+// Put adds a put to the transaction.
+func (tx *Tx) Put(p *dynamo.Put) {
+	tx.put("put", p)
+}
+
+// Update adds an update to the transaction.
+func (tx *Tx) Update(u *dynamo.Update) {
+	tx.update("update", u)
+}
+
+// Delete adds a delete to the transaction.
+func (tx *Tx) Delete(d *dynamo.Delete) {
+	tx.delete("delete", d)
+}
+
+// Check adds a condition check to the transaction.
+func (tx *Tx) Check(c *dynamo.ConditionCheck) {
+	tx.add("check", func(wtx *dynamo.WriteTx) { wtx.Check(c) })
+}
+
+// Len returns the number of operations in the transaction.
+func (tx *Tx) Len() int {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return len(tx.ops)
+}
+
+// Commit atomically applies all operations of the transaction. If the
+// transaction is canceled the returned TxError has ErrTxCanceled set and
+// contains the cancellation reasons. A transaction with more than MaxTxItems
+// operations is not sent and returns ErrTxTooLarge. A transaction that failed
+// can be committed again, for example after a transaction conflict or
+// throttling.
+func (tx *Tx) Commit(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.committed {
+		return TxError{Err: ErrTxAlreadyCommitted}
+	}
+	if len(tx.ops) > MaxTxItems {
+		return TxError{
+			Err:     ErrTxTooLarge,
+			BaseErr: fmt.Errorf("%d operations", len(tx.ops)),
+		}
+	}
+	if len(tx.ops) == 0 {
+		tx.committed = true
+		return nil
+	}
+
+	wtx := tx.db.WriteTx()
+	for _, op := range tx.ops {
+		op.add(wtx)
+	}
+	if err := wtx.RunWithContext(ctx); err != nil {
+		if err, ok := err.(awserr.Error); ok && err.Code() == dynamodb.ErrCodeTransactionCanceledException {
+			return TxError{
+				Err:     ErrTxCanceled,
+				BaseErr: err,
+				Reasons: tx.cancellationReasons(err.Message()),
+			}
+		}
+		return TxError{
+			Err:     ErrCouldNotCommitTx,
+			BaseErr: err,
+		}
+	}
+	tx.committed = true
+
+	return nil
+}
+
+func (tx *Tx) put(desc string, p *dynamo.Put) {
+	tx.add(desc, func(wtx *dynamo.WriteTx) { wtx.Put(p) })
+}
+
+func (tx *Tx) update(desc string, u *dynamo.Update) {
+	tx.add(desc, func(wtx *dynamo.WriteTx) { wtx.Update(u) })
+}
+
+func (tx *Tx) delete(desc string, d *dynamo.Delete) {
+	tx.add(desc, func(wtx *dynamo.WriteTx) { wtx.Delete(d) })
+}
+
+func (tx *Tx) add(desc string, f func(*dynamo.WriteTx)) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.ops = append(tx.ops, txOp{desc: desc, add: f})
+}
+
+// addAll adds all operations or none, if they would make the transaction
+// larger than MaxTxItems or write an item that is already written.
+func (tx *Tx) addAll(ops []txOp) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if len(tx.ops)+len(ops) > MaxTxItems {
+		return ErrTxTooLarge
+	}
+	for _, op := range ops {
+		if op.item == "" {
+			continue
+		}
+		for _, added := range tx.ops {
+			if added.item == op.item {
+				return ErrTxDuplicateItem
+			}
+		}
+	}
+	tx.ops = append(tx.ops, ops...)
+	return nil
+}
+
+func putOp(desc, item string, p *dynamo.Put) txOp {
+	return txOp{desc: desc, item: item, add: func(wtx *dynamo.WriteTx) { wtx.Put(p) }}
+}
+
+func updateOp(desc, item string, u *dynamo.Update) txOp {
+	return txOp{desc: desc, item: item, add: func(wtx *dynamo.WriteTx) { wtx.Update(u) }}
+}
+
+func deleteOp(desc, item string, d *dynamo.Delete) txOp {
+	return txOp{desc: desc, item: item, add: func(wtx *dynamo.WriteTx) { wtx.Delete(d) }}
+}
+
+// cancellationReasons returns the cancellation reasons of the error message
+// with the descriptions of the operations.
+func (tx *Tx) cancellationReasons(msg string) []TxCancellationReason {
+	reasons := parseCancellationReasons(msg)
+	for i := range reasons {
+		if i < len(tx.ops) {
+			reasons[i].Operation = tx.ops[i].desc
+		}
+	}
+	return reasons
+}
+
+// parseCancellationReasons parses the cancellation reasons from the error
+// message, as the reasons are not part of the error in this version of the
+// AWS SDK. The message ends with the list of reasons, for example
+// "Transaction cancelled, please refer cancellation reasons for specific
+// reasons [None, ConditionalCheckFailed]".
+func parseCancellationReasons(msg string) []TxCancellationReason {
+	start := strings.LastIndex(msg, "[")
+	end := strings.LastIndex(msg, "]")
+	if start < 0 || end < start {
+		return nil
+	}
+
+	codes := strings.Split(msg[start+1:end], ",")
+	reasons := make([]TxCancellationReason, len(codes))
+	for i, code := range codes {
+		reasons[i] = TxCancellationReason{
+			Index: i,
+			Code:  strings.TrimSpace(code),
+		}
+	}
+
+	return reasons
+}
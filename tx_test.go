@@ -0,0 +1,187 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TxTestSuite struct {
+	suite.Suite
+	store *EventStore
+	repo  *Repo
+}
+
+// SetupTest will create the store and repo tables
+func (suite *TxTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{Endpoint: os.Getenv("DYNAMODB_HOST")})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+
+	suite.repo, err = NewRepo(&RepoConfig{
+		TableName: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:  os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.repo.service.CreateTable(suite.repo.config.TableName, TestModel{}).Run(), "could not create table")
+	suite.repo.SetEntityFactory(func() eh.Entity { return &TestModel{} })
+}
+
+// TearDownTest will delete the tables
+func (suite *TxTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+	assert.Nil(suite.T(), suite.repo.service.Table(suite.repo.config.TableName).DeleteTable().Run(), "could not delete table")
+}
+
+func (suite *TxTestSuite) TestCommit() {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	tx := suite.store.NewTx()
+	ctx := NewContextWithTx(context.Background(), tx)
+
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, id, 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), suite.repo.Save(ctx, &TestModel{ID: id, Content: "test"}))
+	assert.Equal(suite.T(), 2, tx.Len())
+
+	// Nothing is written before the commit.
+	events, err := suite.store.Load(context.Background(), id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 0)
+
+	assert.Nil(suite.T(), tx.Commit(context.Background()))
+
+	events, err = suite.store.Load(context.Background(), id)
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), events, 1)
+	entity, err := suite.repo.Find(context.Background(), id)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), id, entity.EntityID())
+
+	err = tx.Commit(context.Background())
+	if txErr, ok := err.(TxError); !ok || txErr.Err != ErrTxAlreadyCommitted {
+		suite.T().Error("there should be an already committed error:", err)
+	}
+}
+
+func (suite *TxTestSuite) TestCommitCanceled() {
+	id := uuid.New()
+
+	tx := suite.repo.NewTx()
+	ctx := NewContextWithTx(context.Background(), tx)
+
+	assert.Nil(suite.T(), suite.repo.Save(ctx, &TestModel{ID: uuid.New(), Content: "test"}))
+	_, err := suite.repo.Update(id).Add("Counter", 1).Run(ctx)
+	assert.Nil(suite.T(), err)
+
+	err = tx.Commit(context.Background())
+	txErr, ok := err.(TxError)
+	if !ok || txErr.Err != ErrTxCanceled {
+		suite.T().Fatal("there should be a canceled error:", err)
+	}
+	if assert.Len(suite.T(), txErr.Reasons, 2) {
+		assert.Equal(suite.T(), "None", txErr.Reasons[0].Code)
+		assert.Equal(suite.T(), "ConditionalCheckFailed", txErr.Reasons[1].Code)
+	}
+
+	entities, err := suite.repo.FindAll(context.Background())
+	assert.Nil(suite.T(), err)
+	assert.Len(suite.T(), entities, 0)
+
+	// A failed transaction can be committed again.
+	err = tx.Commit(context.Background())
+	if txErr, ok := err.(TxError); !ok || txErr.Err != ErrTxCanceled {
+		suite.T().Error("there should be a canceled error:", err)
+	}
+}
+
+// TestTxTestSuite starts the test suite
+func TestTxTestSuite(t *testing.T) {
+	suite.Run(t, new(TxTestSuite))
+}
+
+func TestTxCancellationReasons(t *testing.T) {
+	tx := NewTx(nil)
+	tx.add("first", nil)
+	tx.add("second", nil)
+
+	reasons := tx.cancellationReasons("Transaction cancelled, please refer cancellation reasons for specific reasons [None, ConditionalCheckFailed]")
+	assert.Equal(t, []TxCancellationReason{
+		{Index: 0, Operation: "first", Code: "None"},
+		{Index: 1, Operation: "second", Code: "ConditionalCheckFailed"},
+	}, reasons)
+
+	assert.Nil(t, tx.cancellationReasons("Transaction cancelled"))
+}
+
+func TestParseCancellationReasons(t *testing.T) {
+	assert.Equal(t, []TxCancellationReason{
+		{Index: 0, Code: "TransactionConflict"},
+		{Index: 1, Code: "None"},
+		{Index: 2, Code: "ThrottlingError"},
+	}, parseCancellationReasons("Transaction cancelled, please refer cancellation reasons for specific reasons [TransactionConflict,None, ThrottlingError]"))
+	assert.Equal(t, []TxCancellationReason{
+		{Index: 0, Code: "ConditionalCheckFailed"},
+	}, parseCancellationReasons("Transaction cancelled [see item [0]] [ConditionalCheckFailed]"))
+
+	assert.Nil(t, parseCancellationReasons(""))
+	assert.Nil(t, parseCancellationReasons("Transaction cancelled ] ["))
+}
+
+func TestTxTooLarge(t *testing.T) {
+	tx := NewTx(nil)
+	assert.Nil(t, tx.addAll(make([]txOp, MaxTxItems)))
+	assert.Equal(t, ErrTxTooLarge, tx.addAll(make([]txOp, 1)))
+	assert.Equal(t, MaxTxItems, tx.Len())
+
+	tx.add("extra", nil)
+	err := tx.Commit(context.Background())
+	if txErr, ok := err.(TxError); !ok || txErr.Err != ErrTxTooLarge {
+		t.Error("there should be a transaction too large error:", err)
+	}
+}
+
+func TestSaveInTxInvalidEvent(t *testing.T) {
+	store := NewEventStoreWithDB(&EventStoreConfig{}, nil)
+	tx := NewTx(nil)
+	ctx := NewContextWithTx(context.Background(), tx)
+	id := uuid.New()
+
+	// No writes are added when an event is invalid.
+	err := store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			time.Now(), mocks.AggregateType, id, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event3"},
+			time.Now(), mocks.AggregateType, id, 3),
+	}, 0)
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != eh.ErrIncorrectEventVersion {
+		t.Error("there should be an incorrect event version error:", err)
+	}
+	assert.Equal(t, 0, tx.Len())
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrEventTypeIndexNotEnabled is when events are loaded by event type but
+// the event type index is not enabled in the config.
+var ErrEventTypeIndexNotEnabled = errors.New("event type index not enabled")
+
+// ErrAggregateTypeIndexNotEnabled is when events are loaded by aggregate
+// type but the aggregate type index is not enabled in the config.
+var ErrAggregateTypeIndexNotEnabled = errors.New("aggregate type index not enabled")
+
+// eventTypeIndex is the global secondary index of events by event type,
+// sorted by the timestamp in Unix nanoseconds.
+var eventTypeIndex = dynamo.Index{
+	Name:         "EventTypeIndex",
+	HashKey:      "EventType",
+	HashKeyType:  dynamo.StringType,
+	RangeKey:     "TimeNano",
+	RangeKeyType: dynamo.NumberType,
+}
+
+// aggregateTypeIndex is the global secondary index of events by aggregate
+// type, sorted by the timestamp in Unix nanoseconds.
+var aggregateTypeIndex = dynamo.Index{
+	Name:         "AggregateTypeIndex",
+	HashKey:      "AggregateType",
+	HashKeyType:  dynamo.StringType,
+	RangeKey:     "TimeNano",
+	RangeKeyType: dynamo.NumberType,
+}
+
+// LoadByEventType loads a page of at most limit events of the event type,
+// sorted by timestamp. Pass an empty cursor for the first page and the
+// returned cursor for the next, until it is empty. A limit of 0 loads all
+// remaining events. Only events saved with EventTypeIndex enabled are found,
+// and the reads are always eventually consistent.
+func (s *EventStore) LoadByEventType(ctx context.Context, eventType eh.EventType, limit int, cursor string) ([]eh.Event, string, error) {
+	if !s.config.EventTypeIndex {
+		return nil, "", eh.EventStoreError{
+			Err:       ErrEventTypeIndexNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return s.loadByIndex(ctx, eventTypeIndex, string(eventType), limit, cursor)
+}
+
+// LoadByAggregateType loads a page of at most limit events for aggregates of
+// the aggregate type, sorted by timestamp. Paging works as for
+// LoadByEventType. Only events saved with AggregateTypeIndex enabled are
+// found, and the reads are always eventually consistent.
+func (s *EventStore) LoadByAggregateType(ctx context.Context, aggregateType eh.AggregateType, limit int, cursor string) ([]eh.Event, string, error) {
+	if !s.config.AggregateTypeIndex {
+		return nil, "", eh.EventStoreError{
+			Err:       ErrAggregateTypeIndexNotEnabled,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return s.loadByIndex(ctx, aggregateTypeIndex, string(aggregateType), limit, cursor)
+}
+
+func (s *EventStore) loadByIndex(ctx context.Context, index dynamo.Index, value string, limit int, cursor string) ([]eh.Event, string, error) {
+	startKey, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", eh.EventStoreError{
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	table := s.service.Table(s.TableName(ctx))
+	query := table.Get(index.HashKey, value).Index(index.Name)
+	if startKey != nil {
+		query = query.StartFrom(startKey)
+	}
+	if limit > 0 {
+		query = query.Limit(int64(limit))
+	}
+
+	var dbEvents []dbEvent
+	lastKey, err := query.AllWithLastEvaluatedKeyContext(ctx, &dbEvents)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, "", eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	events, err := s.buildEvents(ctx, dbEvents)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next, err := encodeCursor(lastKey)
+	if err != nil {
+		return nil, "", eh.EventStoreError{
+			BaseErr:   err,
+			Err:       ErrCouldNotQuery,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return events, next, nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type TypeIndexTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event table with the type indexes
+func (suite *TypeIndexTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix:        "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:           os.Getenv("DYNAMODB_HOST"),
+		EventTypeIndex:     true,
+		AggregateTypeIndex: true,
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the table
+func (suite *TypeIndexTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *TypeIndexTestSuite) TestLoadByType() {
+	ctx := context.Background()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		err := suite.store.Save(ctx, []eh.Event{
+			eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+				timestamp.Add(time.Duration(i)*time.Second), mocks.AggregateType, uuid.New(), 1),
+		}, 0)
+		assert.Nil(suite.T(), err)
+	}
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventOtherType, nil,
+			timestamp, mocks.AggregateType, uuid.New(), 1),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// Page through the events of one type.
+	var events []eh.Event
+	cursor := ""
+	for {
+		page, next, err := suite.store.LoadByEventType(ctx, mocks.EventType, 2, cursor)
+		assert.Nil(suite.T(), err)
+		events = append(events, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if assert.Len(suite.T(), events, 3) {
+		for i, e := range events {
+			assert.Equal(suite.T(), mocks.EventType, e.EventType())
+			assert.Equal(suite.T(), timestamp.Add(time.Duration(i)*time.Second), e.Timestamp())
+		}
+	}
+
+	events, cursor, err = suite.store.LoadByAggregateType(ctx, mocks.AggregateType, 0, "")
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), "", cursor)
+	assert.Len(suite.T(), events, 4)
+
+	_, _, err = suite.store.LoadByEventType(ctx, mocks.EventType, 2, "invalid")
+	if storeErr, ok := err.(eh.EventStoreError); !ok || storeErr.Err != ErrInvalidCursor {
+		suite.T().Error("there should be an invalid cursor error:", err)
+	}
+}
+
+// TestTypeIndexTestSuite starts the test suite
+func TestTypeIndexTestSuite(t *testing.T) {
+	suite.Run(t, new(TypeIndexTestSuite))
+}
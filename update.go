@@ -0,0 +1,133 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ErrCouldNotUpdateEntity is when an entity could not be updated.
+var ErrCouldNotUpdateEntity = errors.New("could not update entity")
+
+// Update is a partial update of a stored entity, applied atomically by
+// DynamoDB. Create one with Repo.Update.
+type Update struct {
+	repo   *Repo
+	id     uuid.UUID
+	update *dynamo.Update
+	upsert bool
+	// checked is set when the condition that the entity exists is added, to
+	// add it only once if the update is run again.
+	checked bool
+}
+
+// Update creates a new partial update of the entity with the ID. By default
+// the update fails with eh.ErrEntityNotFound if the entity does not exist.
+func (r *Repo) Update(id uuid.UUID) *Update {
+	table := r.service.Table(r.config.TableName)
+	return &Update{
+		repo:   r,
+		id:     id,
+		update: table.Update("ID", id.String()),
+	}
+}
+
+// Set sets the attribute at path to value.
+func (u *Update) Set(path string, value interface{}) *Update {
+	u.update.Set(path, value)
+	return u
+}
+
+// SetIfNotExists sets the attribute at path to value if it is not yet set.
+func (u *Update) SetIfNotExists(path string, value interface{}) *Update {
+	u.update.SetIfNotExists(path, value)
+	return u
+}
+
+// Add atomically adds value to the number at path, or adds the values of a
+// set to the set at path.
+func (u *Update) Add(path string, value interface{}) *Update {
+	u.update.Add(path, value)
+	return u
+}
+
+// Append appends value, which must be a slice, to the list at path.
+func (u *Update) Append(path string, value interface{}) *Update {
+	u.update.Append(path, value)
+	return u
+}
+
+// Remove removes the attributes at paths.
+func (u *Update) Remove(paths ...string) *Update {
+	u.update.Remove(paths...)
+	return u
+}
+
+// If adds a condition that must be met for the update to be applied.
+// Multiple calls are combined with AND. The update fails with
+// ErrConditionFailed if the condition is not met.
+func (u *Update) If(expr string, args ...interface{}) *Update {
+	u.update.If(expr, args...)
+	return u
+}
+
+// Upsert makes the update create the entity if it does not exist.
+func (u *Update) Upsert() *Update {
+	u.upsert = true
+	return u
+}
+
+// Run applies the update and returns the updated entity. If the context has
+// a transaction the update is added to it and a nil entity is returned.
+func (u *Update) Run(ctx context.Context) (eh.Entity, error) {
+	if !u.upsert && !u.checked {
+		u.update.If("attribute_exists(ID)")
+		u.checked = true
+	}
+
+	// Defer the write to the transaction if there is one, the updated
+	// entity is not known until the transaction is committed.
+	if tx := TxFromContext(ctx); tx != nil {
+		tx.update(fmt.Sprintf("update entity %s in %s", u.id, u.repo.config.TableName), u.update)
+		return nil, nil
+	}
+
+	if u.repo.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	entity := u.repo.factoryFn()
+	if err := u.update.ValueWithContext(ctx, entity); err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, u.repo.conditionError(ctx, u.id, err, !u.upsert)
+		}
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotUpdateEntity,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	return entity, nil
+}
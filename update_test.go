@@ -0,0 +1,82 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/stretchr/testify/assert"
+)
+
+func (suite *RepoTestSuite) TestUpdate() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test", Counter: 1, Tags: []string{"a"}}
+	_ = suite.repo.Save(context.Background(), testModel)
+
+	result, err := suite.repo.Update(testModel.ID).
+		Add("Counter", 2).
+		Append("Tags", []string{"b"}).
+		Set("Content", "updated").
+		Remove("FilterableSortKey").
+		If("Counter = ?", 1).
+		Run(context.Background())
+	if err != nil {
+		suite.T().Fatal("error updating entity:", err)
+	}
+	assert.Equal(suite.T(), &TestModel{ID: testModel.ID, Content: "updated", Counter: 3, Tags: []string{"a", "b"}}, result)
+
+	result, err = suite.repo.Find(context.Background(), testModel.ID)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, result.(*TestModel).Counter)
+}
+
+func (suite *RepoTestSuite) TestUpdateConditionFailed() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test", Counter: 1}
+	_ = suite.repo.Save(context.Background(), testModel)
+
+	result, err := suite.repo.Update(testModel.ID).
+		Add("Counter", 1).
+		If("Counter = ?", 2).
+		Run(context.Background())
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrConditionFailed || result != nil {
+		suite.T().Fatal("there should be a condition failed error:", err)
+	}
+}
+
+func (suite *RepoTestSuite) TestUpdateNotFound() {
+	id := uuid.New()
+	result, err := suite.repo.Update(id).Add("Counter", 1).Run(context.Background())
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != eh.ErrEntityNotFound || result != nil {
+		suite.T().Fatal("there should be a not found error:", err)
+	}
+
+	result, err = suite.repo.Update(id).Add("Counter", 1).Upsert().Run(context.Background())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), &TestModel{ID: id, Counter: 1}, result)
+}
+
+func (suite *RepoTestSuite) TestUpdateRunTwice() {
+	testModel := &TestModel{ID: uuid.New(), Content: "test", Counter: 1}
+	_ = suite.repo.Save(context.Background(), testModel)
+
+	// The update can be run again, with the same conditions.
+	update := suite.repo.Update(testModel.ID).Add("Counter", 1)
+	_, err := update.Run(context.Background())
+	assert.Nil(suite.T(), err)
+	result, err := update.Run(context.Background())
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), 3, result.(*TestModel).Counter)
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// VerifyIssueKind is the kind of an integrity issue.
+type VerifyIssueKind string
+
+const (
+	// VerifyMissingVersion is a range of versions missing before the last
+	// event of an aggregate.
+	VerifyMissingVersion VerifyIssueKind = "missing_version"
+	// VerifyUnknownEventType is an event type not registered with
+	// eh.RegisterEventData, unless it is a dataless event type of the config
+	// and the event has no data.
+	VerifyUnknownEventType VerifyIssueKind = "unknown_event_type"
+	// VerifyUndecodableData is event data that can not be unmarshaled into
+	// the registered data type.
+	VerifyUndecodableData VerifyIssueKind = "undecodable_data"
+	// VerifyAggregateTypeMismatch is an event with another aggregate type
+	// than the first event of the aggregate.
+	VerifyAggregateTypeMismatch VerifyIssueKind = "aggregate_type_mismatch"
+	// VerifyTimestampBackwards is an event with an earlier timestamp than the
+	// event before it.
+	VerifyTimestampBackwards VerifyIssueKind = "timestamp_backwards"
+)
+
+// VerifyIssue is an integrity issue of an event or aggregate.
+type VerifyIssue struct {
+	AggregateID uuid.UUID `json:"aggregate_id"`
+	// Version is the version of the event, or the first version of a
+	// missing range that ends at ToVersion.
+	Version   int             `json:"version"`
+	ToVersion int             `json:"to_version,omitempty"`
+	Kind      VerifyIssueKind `json:"kind"`
+	Detail    string          `json:"detail"`
+}
+
+// VerifyReport is the result of a verification, which can be encoded as JSON.
+type VerifyReport struct {
+	Namespace  string `json:"namespace"`
+	Events     int64  `json:"events"`
+	Aggregates int64  `json:"aggregates"`
+	// Issues are sorted by aggregate ID and version.
+	Issues []VerifyIssue `json:"issues"`
+}
+
+// Valid returns true if no issues were found.
+func (r *VerifyReport) Valid() bool {
+	return len(r.Issues) == 0
+}
+
+// VerifierConfig is a config for the Verifier.
+type VerifierConfig struct {
+	// Segments is the number of table segments scanned in parallel, defaults
+	// to 4.
+	Segments int
+	// PageSize is the max number of items scanned per page, defaults to 100.
+	PageSize int
+	// DatalessEventTypes are event types without data that are not
+	// registered with eh.RegisterEventData, which are not reported as
+	// unknown.
+	DatalessEventTypes []eh.EventType
+}
+
+func (c *VerifierConfig) provideDefaults() {
+	if c.Segments == 0 {
+		c.Segments = 4
+	}
+	if c.PageSize == 0 {
+		c.PageSize = 100
+	}
+}
+
+// Verifier checks the integrity of the stored events. Versions are unique
+// per aggregate by the table key, so they are not checked for duplicates.
+type Verifier struct {
+	store  *EventStore
+	config *VerifierConfig
+}
+
+// NewVerifier creates a new Verifier for the event store.
+func NewVerifier(store *EventStore, config *VerifierConfig) *Verifier {
+	if config == nil {
+		config = &VerifierConfig{}
+	}
+	config.provideDefaults()
+
+	return &Verifier{
+		store:  store,
+		config: config,
+	}
+}
+
+// Verify scans the event table of the namespace in the context and reports
+// the issues of all aggregates. The versions and timestamps of every
+// aggregate are kept in memory until the scan is done.
+func (v *Verifier) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{
+		Namespace: eh.NamespaceFromContext(ctx),
+		Issues:    []VerifyIssue{},
+	}
+	aggregates := map[uuid.UUID][]verifyEvent{}
+
+	var mu sync.Mutex
+	scan := &segmentScan{
+		segments: v.config.Segments,
+		pageSize: int64(v.config.PageSize),
+	}
+	err := v.store.runSegmentScan(ctx, scan, func(ctx context.Context, page []dbEvent, scanned int64) error {
+		var issues []VerifyIssue
+		for _, e := range page {
+			issues = append(issues, v.verifyData(&e)...)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		report.Events += int64(len(page))
+		report.Issues = append(report.Issues, issues...)
+		for _, e := range page {
+			aggregates[e.AggregateID] = append(aggregates[e.AggregateID], newVerifyEvent(&e))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	for id, events := range aggregates {
+		report.Issues = append(report.Issues, verifyAggregate(id, events, v.store.config.Retention)...)
+	}
+	report.Aggregates = int64(len(aggregates))
+	sortVerifyIssues(report.Issues)
+
+	return report, nil
+}
+
+// VerifyAggregate reports the issues of one aggregate.
+func (v *Verifier) VerifyAggregate(ctx context.Context, id uuid.UUID) (*VerifyReport, error) {
+	table := v.store.service.Table(v.store.TableName(ctx))
+
+	var dbEvents []dbEvent
+	err := table.Get("AggregateID", id.String()).Consistent(true).AllWithContext(ctx, &dbEvents)
+	if err != nil && err != dynamo.ErrNotFound {
+		return nil, eh.EventStoreError{
+			BaseErr:   err,
+			Err:       err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	report := &VerifyReport{
+		Namespace: eh.NamespaceFromContext(ctx),
+		Events:    int64(len(dbEvents)),
+		Issues:    []VerifyIssue{},
+	}
+	if len(dbEvents) == 0 {
+		return report, nil
+	}
+	report.Aggregates = 1
+
+	events := make([]verifyEvent, len(dbEvents))
+	for i, e := range dbEvents {
+		report.Issues = append(report.Issues, v.verifyData(&e)...)
+		events[i] = newVerifyEvent(&e)
+	}
+	report.Issues = append(report.Issues, verifyAggregate(id, events, v.store.config.Retention)...)
+	sortVerifyIssues(report.Issues)
+
+	return report, nil
+}
+
+// verifyEvent is the part of an event needed to verify its aggregate.
+type verifyEvent struct {
+	version       int
+	aggregateType eh.AggregateType
+	timestamp     time.Time
+}
+
+func newVerifyEvent(e *dbEvent) verifyEvent {
+	return verifyEvent{
+		version:       e.Version,
+		aggregateType: e.AggregateType,
+		timestamp:     e.Timestamp,
+	}
+}
+
+// verifyData reports if the event type is unknown or the data of an event
+// can not be decoded.
+func (v *Verifier) verifyData(e *dbEvent) []VerifyIssue {
+	data, err := eh.CreateEventData(e.EventType)
+	if err != nil {
+		for _, t := range v.config.DatalessEventTypes {
+			if t == e.EventType && len(e.RawData) == 0 {
+				return nil
+			}
+		}
+		return []VerifyIssue{{
+			AggregateID: e.AggregateID,
+			Version:     e.Version,
+			Kind:        VerifyUnknownEventType,
+			Detail:      fmt.Sprintf("event type %s is not registered", e.EventType),
+		}}
+	}
+	if err := dynamodbattribute.UnmarshalMap(e.RawData, data); err != nil {
+		return []VerifyIssue{{
+			AggregateID: e.AggregateID,
+			Version:     e.Version,
+			Kind:        VerifyUndecodableData,
+			Detail:      err.Error(),
+		}}
+	}
+
+	return nil
+}
+
+// verifyAggregate reports the issues between the events of an aggregate.
+// Versions before the first event are reported as missing only if the
+// aggregate type has no retention, else they can have expired.
+func verifyAggregate(id uuid.UUID, events []verifyEvent, retention map[eh.AggregateType]time.Duration) []VerifyIssue {
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].version < events[j].version
+	})
+
+	var issues []VerifyIssue
+	first := events[0]
+	if _, ok := retention[first.aggregateType]; !ok && first.version > 1 {
+		issues = append(issues, missingVersions(id, 1, first.version-1))
+	}
+	for i := 1; i < len(events); i++ {
+		prev, e := events[i-1], events[i]
+		if e.version > prev.version+1 {
+			issues = append(issues, missingVersions(id, prev.version+1, e.version-1))
+		}
+		if e.aggregateType != first.aggregateType {
+			issues = append(issues, VerifyIssue{
+				AggregateID: id,
+				Version:     e.version,
+				Kind:        VerifyAggregateTypeMismatch,
+				Detail:      fmt.Sprintf("aggregate type %s, not %s as version %d", e.aggregateType, first.aggregateType, first.version),
+			})
+		}
+		if e.timestamp.Before(prev.timestamp) {
+			issues = append(issues, VerifyIssue{
+				AggregateID: id,
+				Version:     e.version,
+				Kind:        VerifyTimestampBackwards,
+				Detail:      fmt.Sprintf("timestamp %s is before %s of version %d", e.timestamp.Format(time.RFC3339Nano), prev.timestamp.Format(time.RFC3339Nano), prev.version),
+			})
+		}
+	}
+
+	return issues
+}
+
+// missingVersions returns the issue of a missing range of versions.
+func missingVersions(id uuid.UUID, from, to int) VerifyIssue {
+	detail := fmt.Sprintf("version %d is missing", from)
+	if to > from {
+		detail = fmt.Sprintf("versions %d to %d are missing", from, to)
+	}
+	return VerifyIssue{
+		AggregateID: id,
+		Version:     from,
+		ToVersion:   to,
+		Kind:        VerifyMissingVersion,
+		Detail:      detail,
+	}
+}
+
+// sortVerifyIssues sorts issues by aggregate ID and version, keeping the
+// order of issues of the same event.
+func sortVerifyIssues(issues []VerifyIssue) {
+	sort.SliceStable(issues, func(i, j int) bool {
+		if c := bytes.Compare(issues[i].AggregateID[:], issues[j].AggregateID[:]); c != 0 {
+			return c < 0
+		}
+		return issues[i].Version < issues[j].Version
+	})
+}
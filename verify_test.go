@@ -0,0 +1,176 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/google/uuid"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/looplab/eventhorizon/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type VerifierTestSuite struct {
+	suite.Suite
+	store *EventStore
+}
+
+// SetupTest will create the event table
+func (suite *VerifierTestSuite) SetupTest() {
+	var err error
+	suite.store, err = NewEventStore(&EventStoreConfig{
+		TablePrefix: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:    os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.store.CreateTable(context.Background()), "could not create table")
+}
+
+// TearDownTest will delete the table
+func (suite *VerifierTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.store.DeleteTable(context.Background()), "could not delete table")
+}
+
+func (suite *VerifierTestSuite) TestVerify() {
+	ctx := context.Background()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	valid := uuid.New()
+	err := suite.store.Save(ctx, []eh.Event{
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event1"},
+			timestamp, mocks.AggregateType, valid, 1),
+		eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event2"},
+			timestamp, mocks.AggregateType, valid, 2),
+	}, 0)
+	assert.Nil(suite.T(), err)
+
+	// Write events with a gap directly, as Save does not allow it.
+	broken := uuid.New()
+	table := suite.store.service.Table(suite.store.TableName(ctx))
+	for _, version := range []int{1, 3} {
+		e, err := newDBEvent(ctx, eh.NewEventForAggregate(mocks.EventType, &mocks.EventData{Content: "event"},
+			timestamp, mocks.AggregateType, broken, version))
+		assert.Nil(suite.T(), err)
+		assert.Nil(suite.T(), table.Put(e).Run())
+	}
+
+	verifier := NewVerifier(suite.store, nil)
+	report, err := verifier.Verify(ctx)
+	assert.Nil(suite.T(), err)
+	assert.Equal(suite.T(), int64(4), report.Events)
+	assert.Equal(suite.T(), int64(2), report.Aggregates)
+	assert.Equal(suite.T(), []VerifyIssue{
+		{AggregateID: broken, Version: 2, ToVersion: 2, Kind: VerifyMissingVersion, Detail: "version 2 is missing"},
+	}, report.Issues)
+
+	report, err = verifier.VerifyAggregate(ctx, valid)
+	assert.Nil(suite.T(), err)
+	assert.True(suite.T(), report.Valid())
+	assert.Equal(suite.T(), int64(2), report.Events)
+}
+
+// TestVerifierTestSuite starts the test suite
+func TestVerifierTestSuite(t *testing.T) {
+	suite.Run(t, new(VerifierTestSuite))
+}
+
+func TestVerifyAggregate(t *testing.T) {
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+
+	// Versions before the first event are missing, unless they can have
+	// expired by retention.
+	events := []verifyEvent{
+		{version: 4, aggregateType: mocks.AggregateType, timestamp: timestamp},
+		{version: 3, aggregateType: mocks.AggregateType, timestamp: timestamp},
+	}
+	issues := verifyAggregate(id, events, nil)
+	assert.Equal(t, []VerifyIssue{
+		{AggregateID: id, Version: 1, ToVersion: 2, Kind: VerifyMissingVersion, Detail: "versions 1 to 2 are missing"},
+	}, issues)
+	issues = verifyAggregate(id, events, map[eh.AggregateType]time.Duration{mocks.AggregateType: time.Hour})
+	assert.Empty(t, issues)
+
+	// A gap is one issue.
+	issues = verifyAggregate(id, []verifyEvent{
+		{version: 1, aggregateType: mocks.AggregateType, timestamp: timestamp},
+		{version: 1000000, aggregateType: mocks.AggregateType, timestamp: timestamp},
+	}, nil)
+	assert.Equal(t, []VerifyIssue{
+		{AggregateID: id, Version: 2, ToVersion: 999999, Kind: VerifyMissingVersion, Detail: "versions 2 to 999999 are missing"},
+	}, issues)
+
+	issues = verifyAggregate(id, []verifyEvent{
+		{version: 1, aggregateType: mocks.AggregateType, timestamp: timestamp},
+		{version: 3, aggregateType: "Other", timestamp: timestamp.Add(-time.Second)},
+	}, nil)
+	kinds := []VerifyIssueKind{}
+	for _, issue := range issues {
+		kinds = append(kinds, issue.Kind)
+	}
+	assert.Equal(t, []VerifyIssueKind{
+		VerifyMissingVersion,
+		VerifyAggregateTypeMismatch,
+		VerifyTimestampBackwards,
+	}, kinds)
+	assert.Equal(t, 2, issues[0].Version)
+	assert.Equal(t, 3, issues[2].Version)
+}
+
+func TestVerifyData(t *testing.T) {
+	id := uuid.New()
+	verifier := NewVerifier(nil, &VerifierConfig{
+		DatalessEventTypes: []eh.EventType{"Dataless"},
+	})
+	assert.Empty(t, verifier.verifyData(&dbEvent{AggregateID: id, EventType: "Dataless"}))
+	assert.Empty(t, verifier.verifyData(&dbEvent{AggregateID: id, EventType: mocks.EventType}))
+
+	// Unregistered event types are unknown, with or without data.
+	issues := verifier.verifyData(&dbEvent{AggregateID: id, EventType: "Unregistered"})
+	if assert.Len(t, issues, 1) {
+		assert.Equal(t, VerifyUnknownEventType, issues[0].Kind)
+	}
+
+	issues = verifier.verifyData(&dbEvent{
+		AggregateID: id,
+		Version:     1,
+		EventType:   "Unregistered",
+		RawData: map[string]*dynamodb.AttributeValue{
+			"Content": {S: aws.String("event1")},
+		},
+	})
+	if assert.Len(t, issues, 1) {
+		assert.Equal(t, VerifyUnknownEventType, issues[0].Kind)
+	}
+
+	issues = verifier.verifyData(&dbEvent{
+		AggregateID: id,
+		Version:     1,
+		EventType:   mocks.EventType,
+		RawData: map[string]*dynamodb.AttributeValue{
+			"Content": {BOOL: aws.Bool(true)},
+		},
+	})
+	if assert.Len(t, issues, 1) {
+		assert.Equal(t, VerifyUndecodableData, issues[0].Kind)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+)
+
+// ChangeType is the type of a change of an entity in a repo.
+type ChangeType string
+
+// The types of changes of an entity.
+const (
+	EntityInserted ChangeType = "inserted"
+	EntityModified ChangeType = "modified"
+	EntityRemoved  ChangeType = "removed"
+)
+
+// RepoChange is a change of an entity in a repo. Old is nil for inserted
+// entities and New is nil for removed entities. Depending on the stream view
+// type of the table the old or new entity may not be available.
+type RepoChange struct {
+	Type      ChangeType
+	ID        uuid.UUID
+	Old       eh.Entity
+	New       eh.Entity
+	Timestamp time.Time
+}
+
+// WatchConfig is a config for watching a repo.
+type WatchConfig struct {
+	// Checkpointer stores the stream positions, defaults to an in-memory
+	// checkpointer.
+	Checkpointer StreamCheckpointer
+	// PollInterval is how often the stream is polled when there are no new
+	// records, defaults to one second.
+	PollInterval time.Duration
+	// FromLatest skips all changes made before the watch was started, for
+	// shards without a checkpoint.
+	FromLatest bool
+}
+
+func (c *WatchConfig) provideDefaults() {
+	if c.Checkpointer == nil {
+		c.Checkpointer = NewMemoryStreamCheckpointer()
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = time.Second
+	}
+}
+
+// Watcher delivers the changes of a watched repo.
+type Watcher struct {
+	changes chan RepoChange
+	err     error
+}
+
+// Changes returns the channel of changes, which is closed when the watch is
+// stopped by canceling its context or by an error.
+func (w *Watcher) Changes() <-chan RepoChange {
+	return w.changes
+}
+
+// Err returns the error that stopped the watch, if any. It must only be
+// called after the changes channel is closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Watch tails the stream of the repo table and delivers all entity changes,
+// until the context is canceled. The table must have a stream enabled,
+// preferably with the dynamo.NewAndOldImagesView view type. A change is
+// checkpointed once it has been received from the channel.
+func (r *Repo) Watch(ctx context.Context, config *WatchConfig) (*Watcher, error) {
+	if r.factoryFn == nil {
+		return nil, eh.RepoError{
+			Err:       ErrModelNotSet,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+
+	if config == nil {
+		config = &WatchConfig{}
+	}
+	config.provideDefaults()
+
+	reader, err := newStreamReader(ctx, r.service, r.streams, r.config.TableName)
+	if err != nil {
+		if err == ErrStreamNotEnabled {
+			return nil, eh.RepoError{
+				Err:       err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+		return nil, eh.RepoError{
+			Err:       ErrCouldNotReadStream,
+			BaseErr:   err,
+			Namespace: eh.NamespaceFromContext(ctx),
+		}
+	}
+	reader.checkpointer = config.Checkpointer
+	reader.pollInterval = config.PollInterval
+	reader.fromLatest = config.FromLatest
+
+	w := &Watcher{
+		changes: make(chan RepoChange),
+	}
+	go func() {
+		defer close(w.changes)
+
+		err := reader.run(ctx, func(ctx context.Context, record *dynamodbstreams.Record) error {
+			change, err := r.newRepoChange(record)
+			if err != nil {
+				return err
+			}
+
+			select {
+			case w.changes <- change:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			w.err = eh.RepoError{
+				Err:       ErrCouldNotReadStream,
+				BaseErr:   err,
+				Namespace: eh.NamespaceFromContext(ctx),
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// newRepoChange decodes a stream record to a change.
+func (r *Repo) newRepoChange(record *dynamodbstreams.Record) (RepoChange, error) {
+	change := RepoChange{
+		Timestamp: aws.TimeValue(record.Dynamodb.ApproximateCreationDateTime),
+	}
+
+	switch aws.StringValue(record.EventName) {
+	case dynamodbstreams.OperationTypeInsert:
+		change.Type = EntityInserted
+	case dynamodbstreams.OperationTypeModify:
+		change.Type = EntityModified
+	case dynamodbstreams.OperationTypeRemove:
+		change.Type = EntityRemoved
+	}
+
+	if key, ok := record.Dynamodb.Keys["ID"]; ok {
+		id, err := uuid.Parse(aws.StringValue(key.S))
+		if err != nil {
+			return RepoChange{}, err
+		}
+		change.ID = id
+	}
+
+	var err error
+	if change.Old, err = r.decodeImage(record.Dynamodb.OldImage); err != nil {
+		return RepoChange{}, err
+	}
+	if change.New, err = r.decodeImage(record.Dynamodb.NewImage); err != nil {
+		return RepoChange{}, err
+	}
+
+	return change, nil
+}
+
+// decodeImage decodes an item image to an entity, or nil if there is none.
+func (r *Repo) decodeImage(image map[string]*dynamodb.AttributeValue) (eh.Entity, error) {
+	if len(image) == 0 {
+		return nil, nil
+	}
+
+	entity := r.factoryFn()
+	if err := dynamo.UnmarshalItem(image, entity); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
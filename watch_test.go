@@ -0,0 +1,147 @@
+// Copyright (c) 2018 - The Event Horizon DynamoDB authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dynamodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+	"github.com/google/uuid"
+	"github.com/guregu/dynamo"
+	eh "github.com/looplab/eventhorizon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type WatchTestSuite struct {
+	suite.Suite
+	repo *Repo
+}
+
+// SetupTest will create a repo table with a stream
+func (suite *WatchTestSuite) SetupTest() {
+	var err error
+	suite.repo, err = NewRepo(&RepoConfig{
+		TableName: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:  os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err, "there should be no error")
+	assert.Nil(suite.T(), suite.repo.service.CreateTable(suite.repo.config.TableName, TestModel{}).
+		Stream(dynamo.NewAndOldImagesView).Run(), "could not create table")
+	suite.repo.SetEntityFactory(func() eh.Entity { return &TestModel{} })
+}
+
+// TearDownTest will delete the table
+func (suite *WatchTestSuite) TearDownTest() {
+	assert.Nil(suite.T(), suite.repo.service.Table(suite.repo.config.TableName).DeleteTable().Run(), "could not delete table")
+}
+
+func (suite *WatchTestSuite) TestWatch() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	checkpointer := NewMemoryStreamCheckpointer()
+	w, err := suite.repo.Watch(ctx, &WatchConfig{
+		Checkpointer: checkpointer,
+		PollInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		suite.T().Fatal("could not watch repo:", err)
+	}
+
+	id := uuid.New()
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: id, Content: "test"})
+	_ = suite.repo.Save(context.Background(), &TestModel{ID: id, Content: "test2"})
+	_ = suite.repo.Remove(context.Background(), id)
+
+	expected := []RepoChange{
+		{Type: EntityInserted, ID: id, New: &TestModel{ID: id, Content: "test"}},
+		{Type: EntityModified, ID: id, Old: &TestModel{ID: id, Content: "test"}, New: &TestModel{ID: id, Content: "test2"}},
+		{Type: EntityRemoved, ID: id, Old: &TestModel{ID: id, Content: "test2"}},
+	}
+	for _, e := range expected {
+		change, ok := <-w.Changes()
+		if !ok {
+			suite.T().Fatal("the watch should not be stopped:", w.Err())
+		}
+		change.Timestamp = time.Time{}
+		assert.Equal(suite.T(), e, change)
+	}
+
+	cancel()
+	for range w.Changes() {
+	}
+	assert.Nil(suite.T(), w.Err())
+}
+
+func (suite *WatchTestSuite) TestWatchStreamNotEnabled() {
+	repo, err := NewRepo(&RepoConfig{
+		TableName: "eventhorizonTest_" + uuid.New().String(),
+		Endpoint:  os.Getenv("DYNAMODB_HOST"),
+	})
+	assert.Nil(suite.T(), err)
+	assert.Nil(suite.T(), repo.service.CreateTable(repo.config.TableName, TestModel{}).Run())
+	defer repo.service.Table(repo.config.TableName).DeleteTable().Run()
+	repo.SetEntityFactory(func() eh.Entity { return &TestModel{} })
+
+	_, err = repo.Watch(context.Background(), nil)
+	if rrErr, ok := err.(eh.RepoError); !ok || rrErr.Err != ErrStreamNotEnabled {
+		suite.T().Error("there should be a stream not enabled error:", err)
+	}
+}
+
+// TestWatchTestSuite starts the test suite
+func TestWatchTestSuite(t *testing.T) {
+	suite.Run(t, new(WatchTestSuite))
+}
+
+func TestNewRepoChange(t *testing.T) {
+	repo := &Repo{}
+	repo.SetEntityFactory(func() eh.Entity { return &TestModel{} })
+
+	id := uuid.New()
+	timestamp := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	change, err := repo.newRepoChange(&dynamodbstreams.Record{
+		EventName: aws.String(dynamodbstreams.OperationTypeModify),
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			ApproximateCreationDateTime: aws.Time(timestamp),
+			Keys: map[string]*dynamodb.AttributeValue{
+				"ID": {S: aws.String(id.String())},
+			},
+			OldImage: map[string]*dynamodb.AttributeValue{
+				"ID":      {S: aws.String(id.String())},
+				"Content": {S: aws.String("old")},
+			},
+			NewImage: map[string]*dynamodb.AttributeValue{
+				"ID":      {S: aws.String(id.String())},
+				"Content": {S: aws.String("new")},
+				"Counter": {N: aws.String("2")},
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, RepoChange{
+		Type:      EntityModified,
+		ID:        id,
+		Old:       &TestModel{ID: id, Content: "old"},
+		New:       &TestModel{ID: id, Content: "new", Counter: 2},
+		Timestamp: timestamp,
+	}, change)
+}